@@ -0,0 +1,156 @@
+package observability
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// LogConfig is kept on the ledger under the "logging" config key and is picked up by the next transaction
+type LogConfig struct {
+	Level  string           `json:"level,omitempty"`  // DEBUG, INFO, NOTICE, WARNING, ERROR or CRITICAL
+	Format string           `json:"format,omitempty"` // "json" or "text"
+	Redact map[string][]int `json:"redact,omitempty"` // positions of the arguments to mask, by function name
+}
+
+const redacted = "***"
+
+// levels from the most to the least verbose
+var logLevels = []shim.LoggingLevel{shim.LogDebug, shim.LogInfo, shim.LogNotice, shim.LogWarning, shim.LogError, shim.LogCritical}
+var logLevelNames = []string{"DEBUG", "INFO", "NOTICE", "WARNING", "ERROR", "CRITICAL"}
+
+func levelRank(level shim.LoggingLevel) int {
+	for i, l := range logLevels {
+		if l == level {
+			return i
+		}
+	}
+	return 0
+}
+
+// Validate rejects unknown levels and formats and negative argument positions
+func (c *LogConfig) Validate() error {
+	if c.Level != "" {
+		if _, err := shim.LogLevel(c.Level); err != nil {
+			return fmt.Errorf("unknown log level %s", c.Level)
+		}
+	}
+	if c.Format != "" && c.Format != "json" && c.Format != "text" {
+		return fmt.Errorf("unknown log format %s, expecting json or text", c.Format)
+	}
+	for function, positions := range c.Redact {
+		for _, p := range positions {
+			if p < 0 {
+				return fmt.Errorf("negative argument position %d to redact for %s", p, function)
+			}
+		}
+	}
+	return nil
+}
+
+// TxLogger tags every line with the transaction, channel, function, caller and time elapsed since the transaction started
+type TxLogger struct {
+	TxID     string
+	Channel  string
+	Function string
+	Caller   string
+	Start    time.Time
+	level    shim.LoggingLevel
+	json     bool
+	redact   []int
+	logger   *shim.ChaincodeLogger
+}
+
+// NewTxLogger writes the lines of the transaction to logger, filtered and formatted as c says
+func NewTxLogger(logger *shim.ChaincodeLogger, stub shim.ChaincodeStubInterface, function string, c *LogConfig) *TxLogger {
+	level, err := shim.LogLevel(c.Level)
+	if err != nil {
+		level = shim.LogInfo
+	}
+
+	return &TxLogger{
+		TxID:     stub.GetTxID(),
+		Channel:  stub.GetChannelID(),
+		Function: function,
+		Start:    time.Now(),
+		level:    level,
+		json:     c.Format == "json",
+		redact:   c.Redact[function],
+		logger:   logger,
+	}
+}
+
+// RedactArgs masks the arguments the logging policy marks as sensitive
+func (l *TxLogger) RedactArgs(args []string) []string {
+	masked := append([]string(nil), args...)
+	for _, p := range l.redact {
+		if p < len(masked) {
+			masked[p] = redacted
+		}
+	}
+	return masked
+}
+
+func (l *TxLogger) log(level shim.LoggingLevel, format string, args ...interface{}) {
+	if levelRank(level) < levelRank(l.level) {
+		return
+	}
+
+	message := fmt.Sprintf(format, args...)
+	duration := time.Since(l.Start)
+
+	var line string
+	if l.json {
+		lineBytes, _ := json.Marshal(map[string]interface{}{
+			"ts":         time.Now().UTC().Format(time.RFC3339Nano),
+			"level":      levelName(level),
+			"txId":       l.TxID,
+			"channel":    l.Channel,
+			"function":   l.Function,
+			"caller":     l.Caller,
+			"durationMs": float64(duration) / float64(time.Millisecond),
+			"msg":        message,
+		})
+		line = string(lineBytes)
+	} else {
+		line = fmt.Sprintf("[tx=%s channel=%s function=%s caller=%s duration=%s] %s",
+			l.TxID, l.Channel, l.Function, l.Caller, duration, message)
+	}
+
+	switch level {
+	case shim.LogDebug:
+		l.logger.Debug(line)
+	case shim.LogInfo:
+		l.logger.Info(line)
+	case shim.LogNotice:
+		l.logger.Notice(line)
+	case shim.LogWarning:
+		l.logger.Warning(line)
+	case shim.LogError:
+		l.logger.Error(line)
+	default:
+		l.logger.Critical(line)
+	}
+}
+
+func levelName(level shim.LoggingLevel) string {
+	return logLevelNames[levelRank(level)]
+}
+
+func (l *TxLogger) Debugf(format string, args ...interface{}) {
+	l.log(shim.LogDebug, format, args...)
+}
+
+func (l *TxLogger) Infof(format string, args ...interface{}) {
+	l.log(shim.LogInfo, format, args...)
+}
+
+func (l *TxLogger) Warningf(format string, args ...interface{}) {
+	l.log(shim.LogWarning, format, args...)
+}
+
+func (l *TxLogger) Errorf(format string, args ...interface{}) {
+	l.log(shim.LogError, format, args...)
+}
@@ -0,0 +1,224 @@
+// Package observability holds the metrics and transaction logging shared by the chaincodes of this
+// network, each chaincode wires them to its own stub and logger.
+package observability
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// address the metrics endpoint listens on, eg ":9102"; metrics are not served when it is empty
+const metricsAddressEnv = "CHAINCODE_METRICS_ADDRESS"
+
+const (
+	invocationsMetric = "chaincode_invocations_total"
+	errorsMetric      = "chaincode_errors_total"
+	durationMetric    = "chaincode_invoke_duration_seconds"
+	stateReadsMetric  = "chaincode_state_reads_total"
+	stateWritesMetric = "chaincode_state_writes_total"
+	readBytesMetric   = "chaincode_state_read_bytes"
+	writeBytesMetric  = "chaincode_state_write_bytes"
+)
+
+var durationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+var sizeBuckets = []float64{64, 256, 1024, 4096, 16384, 65536, 262144, 1048576}
+
+var metricHelp = map[string]string{
+	invocationsMetric: "Chaincode function invocations.",
+	errorsMetric:      "Chaincode function invocations answered with an error status, by status code.",
+	durationMetric:    "Time spent executing chaincode functions.",
+	stateReadsMetric:  "GetState calls made by chaincode functions.",
+	stateWritesMetric: "PutState calls made by chaincode functions.",
+	readBytesMetric:   "Size of values returned by GetState.",
+	writeBytesMetric:  "Size of values passed to PutState.",
+}
+
+type histogram struct {
+	buckets []float64
+	counts  []uint64 // per bucket, not cumulative
+	sum     float64
+	count   uint64
+}
+
+func (h *histogram) observe(v float64) {
+	for i, upper := range h.buckets {
+		if v <= upper {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// family is one metric, its series are keyed by rendered labels
+type family struct {
+	histogram bool
+	counters  map[string]float64
+	buckets   map[string]*histogram
+}
+
+// Registry holds the metrics of the chaincode process
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]*family
+}
+
+// NewRegistry returns an empty registry
+func NewRegistry() *Registry {
+	return &Registry{families: map[string]*family{}}
+}
+
+func labels(pairs ...string) string {
+	var parts []string
+	for i := 0; i+1 < len(pairs); i += 2 {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(pairs[i+1])
+		parts = append(parts, pairs[i]+`="`+value+`"`)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (r *Registry) family(name string, isHistogram bool) *family {
+	f := r.families[name]
+	if f == nil {
+		f = &family{histogram: isHistogram, counters: map[string]float64{}, buckets: map[string]*histogram{}}
+		r.families[name] = f
+	}
+	return f
+}
+
+func (r *Registry) add(name, labels string, delta float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.family(name, false).counters[labels] += delta
+}
+
+func (r *Registry) observe(name, labels string, buckets []float64, v float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f := r.family(name, true)
+	h := f.buckets[labels]
+	if h == nil {
+		h = &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+		f.buckets[labels] = h
+	}
+	h.observe(v)
+}
+
+// ObserveInvoke records the outcome of one chaincode function call
+func (r *Registry) ObserveInvoke(function string, status int32, duration time.Duration) {
+	l := labels("function", function)
+	r.add(invocationsMetric, l, 1)
+	if status >= 400 {
+		r.add(errorsMetric, labels("function", function, "code", strconv.Itoa(int(status))), 1)
+	}
+	r.observe(durationMetric, l, durationBuckets, duration.Seconds())
+}
+
+// ObserveRead counts a state read and its payload size
+func (r *Registry) ObserveRead(function string, size int) {
+	l := labels("function", function)
+	r.add(stateReadsMetric, l, 1)
+	r.observe(readBytesMetric, l, sizeBuckets, float64(size))
+}
+
+// ObserveWrite counts a state write and its payload size
+func (r *Registry) ObserveWrite(function string, size int) {
+	l := labels("function", function)
+	r.add(stateWritesMetric, l, 1)
+	r.observe(writeBytesMetric, l, sizeBuckets, float64(size))
+}
+
+func withLabel(labels, extra string) string {
+	if labels == "" {
+		return "{" + extra + "}"
+	}
+	return "{" + labels + "," + extra + "}"
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// write renders the registry in the prometheus text exposition format
+func (r *Registry) write(w io.Writer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var names []string
+	for name := range r.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		f := r.families[name]
+		if !f.histogram {
+			fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, metricHelp[name], name)
+			var series []string
+			for l := range f.counters {
+				series = append(series, l)
+			}
+			sort.Strings(series)
+			for _, l := range series {
+				fmt.Fprintf(w, "%s{%s} %s\n", name, l, formatFloat(f.counters[l]))
+			}
+			continue
+		}
+
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, metricHelp[name], name)
+		var series []string
+		for l := range f.buckets {
+			series = append(series, l)
+		}
+		sort.Strings(series)
+		for _, l := range series {
+			h := f.buckets[l]
+			var cumulative uint64
+			for i, upper := range h.buckets {
+				cumulative += h.counts[i]
+				fmt.Fprintf(w, "%s_bucket%s %d\n", name, withLabel(l, `le="`+formatFloat(upper)+`"`), cumulative)
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", name, withLabel(l, `le="+Inf"`), h.count)
+			fmt.Fprintf(w, "%s_sum{%s} %s\n", name, l, formatFloat(h.sum))
+			fmt.Fprintf(w, "%s_count{%s} %d\n", name, l, h.count)
+		}
+	}
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.write(w)
+}
+
+// Handler serves the registry on /metrics
+func (r *Registry) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", r)
+	return mux
+}
+
+// Serve exposes the registry on /metrics when CHAINCODE_METRICS_ADDRESS is set
+func (r *Registry) Serve(logger *shim.ChaincodeLogger) {
+	address := os.Getenv(metricsAddressEnv)
+	if address == "" {
+		return
+	}
+
+	mux := r.Handler()
+	go func() {
+		logger.Info("serving metrics on " + address + "/metrics")
+		if err := http.ListenAndServe(address, mux); err != nil {
+			logger.Error("metrics endpoint stopped: " + err.Error())
+		}
+	}()
+}
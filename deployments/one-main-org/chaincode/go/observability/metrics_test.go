@@ -0,0 +1,86 @@
+package observability
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func scrape(t *testing.T, r *Registry) string {
+	server := httptest.NewServer(r.Handler())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /metrics: status %d", resp.StatusCode)
+	}
+	if contentType := resp.Header.Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain") {
+		t.Errorf("GET /metrics: content type %q", contentType)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	r := NewRegistry()
+	r.ObserveInvoke("move", 200, 20*time.Millisecond)
+	r.ObserveInvoke("move", 403, 3*time.Second)
+	r.ObserveInvoke("query", 200, time.Millisecond)
+	r.ObserveRead("move", 100)
+	r.ObserveRead("move", 5000)
+	r.ObserveWrite("move", 2)
+
+	body := scrape(t, r)
+	for _, line := range []string{
+		`# TYPE chaincode_invocations_total counter`,
+		`chaincode_invocations_total{function="move"} 2`,
+		`chaincode_invocations_total{function="query"} 1`,
+		`chaincode_errors_total{function="move",code="403"} 1`,
+		`chaincode_state_reads_total{function="move"} 2`,
+		`chaincode_state_writes_total{function="move"} 1`,
+		`# TYPE chaincode_invoke_duration_seconds histogram`,
+		`chaincode_invoke_duration_seconds_bucket{function="move",le="0.01"} 0`,
+		`chaincode_invoke_duration_seconds_bucket{function="move",le="0.025"} 1`,
+		`chaincode_invoke_duration_seconds_bucket{function="move",le="2.5"} 1`,
+		`chaincode_invoke_duration_seconds_bucket{function="move",le="5"} 2`,
+		`chaincode_invoke_duration_seconds_bucket{function="move",le="+Inf"} 2`,
+		`chaincode_invoke_duration_seconds_sum{function="move"} 3.02`,
+		`chaincode_invoke_duration_seconds_count{function="move"} 2`,
+		`chaincode_state_read_bytes_bucket{function="move",le="64"} 0`,
+		`chaincode_state_read_bytes_bucket{function="move",le="256"} 1`,
+		`chaincode_state_read_bytes_bucket{function="move",le="16384"} 2`,
+		`chaincode_state_read_bytes_sum{function="move"} 5100`,
+		`chaincode_state_write_bytes_bucket{function="move",le="64"} 1`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("missing %q in\n%s", line, body)
+		}
+	}
+	if strings.Contains(body, `chaincode_errors_total{function="query"`) {
+		t.Errorf("successful calls counted as errors:\n%s", body)
+	}
+}
+
+func TestMetricsEndpointPath(t *testing.T) {
+	server := httptest.NewServer(NewRegistry().Handler())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET /: status %d, expected 404", resp.StatusCode)
+	}
+}
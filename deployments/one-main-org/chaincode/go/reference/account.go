@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Entities are active unless their status record under status~entity says otherwise. Frozen and
+// closed entities take neither debits nor credits, deleted ones are tombstones that restore brings
+// back within the retention window. Every transition rewrites the status record, so the history of
+// its key is the audit trail of the entity.
+const statusObjectType = "status"
+
+const (
+	statusActive  = "active"
+	statusFrozen  = "frozen"
+	statusClosed  = "closed"
+	statusDeleted = "deleted"
+)
+
+const defaultRestoreRetention = 30 * 24 * 60 * 60 // seconds
+
+type accountStatus struct {
+	Entity    string `json:"entity"`
+	Status    string `json:"status"`
+	Previous  string `json:"previous"`
+	Reason    string `json:"reason,omitempty"`
+	ChangedBy string `json:"changedBy"`
+	ChangedAt int64  `json:"changedAt"`
+}
+
+// statusError rejects a balance change of an entity that is not active
+type statusError struct {
+	entity string
+	status string
+}
+
+func (e *statusError) Error() string {
+	return "Account " + e.entity + " is " + e.status
+}
+
+// errorResponse answers 403 to balance changes of inactive entities and 500 to other errors
+func errorResponse(err error) pb.Response {
+	if e, ok := err.(*statusError); ok {
+		return pb.Response{Status: 403, Message: e.Error()}
+	}
+	return shim.Error(err.Error())
+}
+
+func getStatus(stub shim.ChaincodeStubInterface, entity string) (*accountStatus, error) {
+	s := &accountStatus{Entity: entity, Status: statusActive}
+	_, err := getJSON(stub, statusObjectType, []string{entity}, s)
+	return s, err
+}
+
+// checkActive fails with a statusError unless the entity is active
+func checkActive(stub shim.ChaincodeStubInterface, entity string) error {
+	s, err := getStatus(stub, entity)
+	if err != nil {
+		return err
+	}
+	if s.Status != statusActive {
+		return &statusError{entity, s.Status}
+	}
+	return nil
+}
+
+func restoreRetention(stub shim.ChaincodeStubInterface) (int64, error) {
+	return configInt(stub, "restoreRetention")
+}
+
+// setStatus records the transition of an entity to a new status
+func setStatus(stub shim.ChaincodeStubInterface, s *accountStatus, status, reason string) pb.Response {
+	id, err := getCreator(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	s.Previous, s.Status, s.Reason = s.Status, status, reason
+	s.ChangedBy, s.ChangedAt = id.name(), now
+	if err = putJSON(stub, statusObjectType, []string{s.Entity}, s); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	statusBytes, err := json.Marshal(s)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err = stub.SetEvent("accountStatus", statusBytes); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(statusBytes)
+}
+
+// transition checks the entity exists and is in one of the given statuses
+func transition(stub shim.ChaincodeStubInterface, entity string, from ...string) (*accountStatus, pb.Response) {
+	found, err := entityExists(stub, entity)
+	if err != nil {
+		return nil, shim.Error(err.Error())
+	}
+	if !found {
+		return nil, pb.Response{Status: 404, Message: "Entity not found"}
+	}
+	s, err := getStatus(stub, entity)
+	if err != nil {
+		return nil, shim.Error(err.Error())
+	}
+	for _, status := range from {
+		if s.Status == status {
+			return s, shim.Success(nil)
+		}
+	}
+	return nil, pb.Response{Status: 403, Message: "Account " + entity + " is " + s.Status}
+}
+
+// stops all debits and credits of an entity: entity and reason
+func (t *SimpleChaincode) freeze(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		return pb.Response{Status: 403, Message: "Incorrect number of arguments. Expecting entity and reason"}
+	}
+
+	s, response := transition(stub, args[0], statusActive)
+	if s == nil {
+		return response
+	}
+
+	return setStatus(stub, s, statusFrozen, args[1])
+}
+
+// lets a frozen entity move funds again: entity and reason
+func (t *SimpleChaincode) unfreeze(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		return pb.Response{Status: 403, Message: "Incorrect number of arguments. Expecting entity and reason"}
+	}
+
+	s, response := transition(stub, args[0], statusFrozen)
+	if s == nil {
+		return response
+	}
+
+	return setStatus(stub, s, statusActive, args[1])
+}
+
+// closes an entity with a zero balance and no holds for good, by its owner or an admin: entity and reason
+func (t *SimpleChaincode) closeAccount(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		return pb.Response{Status: 403, Message: "Incorrect number of arguments. Expecting entity and reason"}
+	}
+
+	id, err := getCreator(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !id.owns(args[0]) && !id.hasRole("admin") {
+		return pb.Response{Status: 403, Message: "Only the owner of " + args[0] + " or an admin may close it"}
+	}
+
+	s, response := transition(stub, args[0], statusActive, statusFrozen)
+	if s == nil {
+		return response
+	}
+	balance, _, err := getBalance(stub, s.Entity)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	available, _, err := availableBalance(stub, s.Entity, "")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if balance != 0 || available != 0 {
+		return pb.Response{Status: 403, Message: "Entity has a non-zero balance or open holds"}
+	}
+
+	return setStatus(stub, s, statusClosed, args[1])
+}
+
+// brings back a deleted entity within the retention window: entity and reason
+func (t *SimpleChaincode) restore(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		return pb.Response{Status: 403, Message: "Incorrect number of arguments. Expecting entity and reason"}
+	}
+
+	s, err := getStatus(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if s.Status != statusDeleted {
+		return pb.Response{Status: 404, Message: "No deleted entity " + args[0]}
+	}
+	retention, err := restoreRetention(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if now >= s.ChangedAt+retention {
+		return pb.Response{Status: 403, Message: "Entity was deleted more than " + strconv.FormatInt(retention, 10) + " seconds ago"}
+	}
+
+	if err = writeAmount(stub, s.Entity, 0); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// it comes back in the status it was deleted in
+	return setStatus(stub, s, s.Previous, args[1])
+}
+
+// status of an entity
+func (t *SimpleChaincode) accountStatus(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return pb.Response{Status: 403, Message: "Incorrect number of arguments. Expecting entity"}
+	}
+
+	s, err := getStatus(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	statusBytes, err := json.Marshal(s)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(statusBytes)
+}
+
+// all status transitions of an entity, oldest first
+func (t *SimpleChaincode) accountHistory(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return pb.Response{Status: 403, Message: "Incorrect number of arguments. Expecting entity"}
+	}
+
+	key, err := stub.CreateCompositeKey(statusObjectType, []string{args[0]})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	it, err := stub.GetHistoryForKey(key)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer it.Close()
+
+	type change struct {
+		TxID string `json:"txId"`
+		accountStatus
+	}
+	history := []change{}
+	for it.HasNext() {
+		modification, err := it.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		c := change{TxID: modification.TxId}
+		if err = json.Unmarshal(modification.Value, &c.accountStatus); err != nil {
+			return shim.Error(err.Error())
+		}
+		history = append(history, c)
+	}
+
+	historyBytes, err := json.Marshal(history)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(historyBytes)
+}
+
+func (t *SimpleChaincode) setRestoreRetention(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return pb.Response{Status: 403, Message: "Incorrect number of arguments. Expecting seconds"}
+	}
+
+	return changeConfig(stub, "restoreRetention", args[0])
+}
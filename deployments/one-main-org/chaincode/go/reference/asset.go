@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Besides the token, named after its symbol and kept in the entity balances, issuers can create
+// other assets. Their balances live under asset~name~entity and are not part of the total supply.
+// No asset may be named after the token symbol, and the symbol cannot change to the name of one.
+const assetObjectType = "asset"
+
+// isToken tells whether the asset is the token of the entity balances
+func isToken(stub shim.ChaincodeStubInterface, asset string) (bool, error) {
+	info, err := getTokenInfo(stub)
+	if err != nil {
+		return false, err
+	}
+	return asset == info.Symbol, nil
+}
+
+// assetIssued tells whether units of an asset other than the token were ever created
+func assetIssued(stub shim.ChaincodeStubInterface, asset string) (bool, error) {
+	it, err := stub.GetStateByPartialCompositeKey(assetObjectType, []string{asset})
+	if err != nil {
+		return false, err
+	}
+	defer it.Close()
+	return it.HasNext(), nil
+}
+
+// assetAvailable is what an entity can spend of an asset, its available balance for the token
+func assetAvailable(stub shim.ChaincodeStubInterface, asset, entity string, token bool) (int, error) {
+	if token {
+		available, _, err := availableBalance(stub, entity, "")
+		return available, err
+	}
+
+	key, err := stub.CreateCompositeKey(assetObjectType, []string{asset, entity})
+	if err != nil {
+		return 0, err
+	}
+	balance, _, err := readAmount(stub, key)
+	return balance, err
+}
+
+// addAsset credits a positive or debits a negative amount of an asset to an entity, token
+// entities are created when missing
+func addAsset(stub shim.ChaincodeStubInterface, asset, entity string, amount int, token bool) error {
+	if token {
+		found, err := entityExists(stub, entity)
+		if err != nil {
+			return err
+		}
+		if !found {
+			if err = writeAmount(stub, entity, 0); err != nil {
+				return err
+			}
+		}
+		return applyChanges(stub, map[string]int{entity: amount})
+	}
+
+	if err := checkActive(stub, entity); err != nil {
+		return err
+	}
+	key, err := stub.CreateCompositeKey(assetObjectType, []string{asset, entity})
+	if err != nil {
+		return err
+	}
+	balance, _, err := readAmount(stub, key)
+	if err != nil {
+		return err
+	}
+	txLog(stub).Debugf("%s %s = %d", entity, asset, balance+amount)
+	return writeAmount(stub, key, balance+amount)
+}
+
+// creates units of an asset other than the token on an entity: asset, entity and amount
+func (t *SimpleChaincode) issueAsset(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return pb.Response{Status: 403, Message: "Incorrect number of arguments. Expecting asset, entity and amount"}
+	}
+
+	asset, entity := args[0], args[1]
+	x, err := parseAmount(args[2])
+	if err != nil {
+		return pb.Response{Status: 403, Message: err.Error()}
+	}
+	token, err := isToken(stub, asset)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if token || asset == "" {
+		return pb.Response{Status: 403, Message: fmt.Sprintf("Invalid asset %q, the token is created with mint", asset)}
+	}
+
+	if err = addAsset(stub, asset, entity, x, false); err != nil {
+		return errorResponse(err)
+	}
+
+	eventBytes, err := json.Marshal(map[string]interface{}{"asset": asset, "entity": entity, "amount": x, "txId": stub.GetTxID()})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err = stub.SetEvent("issueAsset", eventBytes); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(eventBytes)
+}
+
+// balance of an entity in an asset, the available balance for the token: asset and entity
+func (t *SimpleChaincode) assetBalance(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		return pb.Response{Status: 403, Message: "Incorrect number of arguments. Expecting asset and entity"}
+	}
+
+	token, err := isToken(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	balance, err := assetAvailable(stub, args[0], args[1], token)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success([]byte(strconv.Itoa(balance)))
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// leg is one payment of a batch
+type leg struct {
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Amount int    `json:"amount"`
+}
+
+// batchSummary is returned by batchMove and sent as its event
+type batchSummary struct {
+	TxID  string         `json:"txId"`
+	Legs  int            `json:"legs"`
+	Total int            `json:"total"`
+	Fees  int            `json:"fees,omitempty"`
+	Net   map[string]int `json:"net"` // after fees, the collectors left out
+}
+
+const maxAmount = int(^uint(0) >> 1)
+
+// netLegs validates every leg and sums their effect per entity, entities are returned sorted.
+// The legs must add up without overflow: every net, fee or per-entity sum of the batch is bounded
+// by the total it returns.
+func netLegs(stub shim.ChaincodeStubInterface, legs []leg) (map[string]int, []string, int, error) {
+	if len(legs) == 0 {
+		return nil, nil, 0, fmt.Errorf("empty batch")
+	}
+
+	net := map[string]int{}
+	total := 0
+	for i, l := range legs {
+		if l.From == "" || l.To == "" {
+			return nil, nil, 0, fmt.Errorf("leg %d: from and to are required", i)
+		}
+		if l.Amount <= 0 {
+			return nil, nil, 0, fmt.Errorf("leg %d: amount must be positive", i)
+		}
+		if l.Amount > maxAmount-total {
+			return nil, nil, 0, fmt.Errorf("leg %d: total of the batch overflows", i)
+		}
+		total += l.Amount
+		net[l.From] -= l.Amount
+		net[l.To] += l.Amount
+	}
+
+	entities := make([]string, 0, len(net))
+	for entity := range net {
+		entities = append(entities, entity)
+	}
+	sort.Strings(entities)
+
+	// entities netting to zero take part in the batch too
+	for _, entity := range entities {
+		found, err := entityExists(stub, entity)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		if !found {
+			return nil, nil, 0, fmt.Errorf("entity %s not found", entity)
+		}
+		if err = checkActive(stub, entity); err != nil {
+			return nil, nil, 0, err
+		}
+	}
+
+	return net, entities, total, nil
+}
+
+// moves between many entities in one transaction, all legs succeed or none do
+func (t *SimpleChaincode) batchMove(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return pb.Response{Status: 403, Message: "Incorrect number of arguments. Expecting legs as json"}
+	}
+
+	var legs []leg
+	if err := json.Unmarshal([]byte(args[0]), &legs); err != nil {
+		return pb.Response{Status: 403, Message: "Invalid legs: " + err.Error()}
+	}
+
+	net, entities, total, err := netLegs(stub, legs)
+	if err != nil {
+		return pb.Response{Status: 403, Message: "Invalid batch: " + err.Error()}
+	}
+
+	// every leg pays the fee of batchMove like a move of its own, its payee receives the net amount
+	fees := map[string]int{}
+	for i, l := range legs {
+		e, err := itemise(stub, "batchMove", l.From, l.To, l.Amount)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if e.Net <= 0 {
+			return pb.Response{Status: 403, Message: fmt.Sprintf("Leg %d: amount %d does not cover the fee of %d", i, e.Value, e.Fee)}
+		}
+		net[l.To] -= e.Fee
+		fees[e.Collector] += e.Fee
+	}
+
+	// like move, the caller spends from entities it does not own out of their allowances, summed
+	// per owner since the allowance read does not see what an earlier leg took off it
+	id, err := getCreator(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	spent := map[string]int{}
+	for _, l := range legs {
+		if !id.owns(l.From) {
+			spent[l.From] += l.Amount
+		}
+	}
+	for _, entity := range entities {
+		if spent[entity] == 0 {
+			continue
+		}
+		if response := spendAllowance(stub, entity, id.name(), spent[entity]); response.Status >= shim.ERRORTHRESHOLD {
+			return response
+		}
+	}
+
+	// only the net debit of an entity has to be covered, not every leg on its own
+	for _, entity := range entities {
+		amount := net[entity]
+		if amount >= 0 {
+			continue
+		}
+		available, _, err := availableBalance(stub, entity, "")
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if available+amount < 0 {
+			return pb.Response{Status: 403, Message: fmt.Sprintf("Insufficient funds: %s has %d available, batch debits %d", entity, available, -amount)}
+		}
+	}
+
+	// limits count what every entity sends, not its net debit
+	sent := map[string]int{}
+	for _, l := range legs {
+		sent[l.From] += l.Amount
+	}
+	if response := spendVelocity(stub, sent, nil); response.Status >= shim.ERRORTHRESHOLD {
+		return response
+	}
+
+	err = applyChanges(stub, net)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if err = creditFees(stub, fees); err != nil {
+		return errorResponse(err)
+	}
+
+	summary := batchSummary{TxID: stub.GetTxID(), Legs: len(legs), Total: total, Net: net}
+	for _, fee := range fees {
+		summary.Fees += fee
+	}
+	summaryBytes, err := json.Marshal(summary)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.SetEvent("batchMove", summaryBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(summaryBytes)
+}
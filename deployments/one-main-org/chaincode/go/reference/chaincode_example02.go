@@ -6,8 +6,8 @@ import (
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	pb "github.com/hyperledger/fabric/protos/peer"
-	"encoding/pem"
-	"crypto/x509"
+	"encoding/json"
+	"time"
 	"strings"
 )
 
@@ -18,9 +18,10 @@ type SimpleChaincode struct {
 }
 
 func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
-	logger.Debug("Init")
+	function, args := stub.GetFunctionAndParameters()
+	log := newTxLogger(stub, function)
+	log.Debugf("Init %v", log.RedactArgs(args))
 
-	_, args := stub.GetFunctionAndParameters()
 	var a, b string    // Entities
 	var aVal, bVal int // Asset holdings
 	var err error
@@ -40,15 +41,31 @@ func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
 	if err != nil {
 		return pb.Response{Status:403, Message:"Expecting integer value for asset holding"}
 	}
-	logger.Debugf("aVal, bVal = %d", aVal, bVal)
+	log.Debugf("aVal = %d, bVal = %d", aVal, bVal)
+
+	// Init sets holdings instead of moving them, the total supply changes by the difference
+	holdings := map[string]int{a: aVal}
+	holdings[b] = bVal
+	var supplyChange int
+	for entity, val := range holdings {
+		oldVal, _, err := readAmount(stub, entity)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		supplyChange += val - oldVal
+	}
+	err = adjustSupply(stub, supplyChange)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
 	// Write the state to the ledger
-	err = stub.PutState(a, []byte(strconv.Itoa(aVal)))
+	err = writeAmount(stub, a, aVal)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 
-	err = stub.PutState(b, []byte(strconv.Itoa(bVal)))
+	err = writeAmount(stub, b, bVal)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
@@ -56,37 +73,200 @@ func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
 	return shim.Success(nil)
 }
 
+// function is a chaincode function callable through Invoke
+type function struct {
+	handler func(t *SimpleChaincode, stub shim.ChaincodeStubInterface, args []string) pb.Response
+	role    string // role the caller must hold, anyone may call the function if empty
+	// number of arguments of a function changing state that accepts a client request id
+	// as an extra last argument to make retries safe, 0 if it does not
+	idempotentArgs int
+	// privileged function that only runs through a proposal once a quorum rule is set
+	quorum bool
+	// function that does not change state and keeps running while the chaincode is paused
+	readOnly bool
+}
+
+// functions is the access policy of the chaincode: every invocable function and who may call it
+var functions map[string]function
+
+func init() {
+	functions = map[string]function{
+		// Make payment of x units from a to b
+		"move": {handler: (*SimpleChaincode).move, idempotentArgs: 3},
+		// Makes many payments at once, all or none of them
+		"batchMove": {handler: (*SimpleChaincode).batchMove, idempotentArgs: 1},
+		// Deletes an entity with a zero balance from its state, restore brings it back for a while.
+		// The reason is optional, a request id is only read as the third argument after a reason
+		"delete": {handler: (*SimpleChaincode).delete, idempotentArgs: 2},
+		// Creates and destroys units, keeping the total supply
+		"mint": {handler: (*SimpleChaincode).mint, role: "issuer", idempotentArgs: 2, quorum: true},
+		"burn": {handler: (*SimpleChaincode).burn, role: "issuer", idempotentArgs: 2, quorum: true},
+		"totalSupply": {handler: (*SimpleChaincode).totalSupply, readOnly: true},
+		// Compares the total supply with the sum of all balances
+		"checkSupply": {handler: (*SimpleChaincode).checkSupply, readOnly: true},
+		// the old "Query" is now implemented in invoke
+		"query": {handler: (*SimpleChaincode).query, readOnly: true},
+		// Describes the transaction creator as the chaincode sees it
+		"whoami": {handler: (*SimpleChaincode).whoami, readOnly: true},
+		// Sets level, format and argument redaction of the chaincode log
+		"setLogging": {handler: (*SimpleChaincode).setLogging, role: "admin", quorum: true},
+		// Writes balance changes as conflict free delta keys instead of rewriting balances
+		"setDeltaMode": {handler: (*SimpleChaincode).setDeltaMode, role: "admin", quorum: true},
+		// Folds pending deltas into balances
+		"compact": {handler: (*SimpleChaincode).compact},
+		// ERC-20 style token interface, move and query keep working next to it for existing clients
+		"name": {handler: (*SimpleChaincode).name, readOnly: true},
+		"symbol": {handler: (*SimpleChaincode).symbol, readOnly: true},
+		"decimals": {handler: (*SimpleChaincode).decimals, readOnly: true},
+		"setTokenInfo": {handler: (*SimpleChaincode).setTokenInfo, role: "admin", quorum: true},
+		"balanceOf": {handler: (*SimpleChaincode).balanceOf, readOnly: true},
+		"transfer": {handler: (*SimpleChaincode).transfer, idempotentArgs: 2},
+		"approve": {handler: (*SimpleChaincode).approve},
+		"revokeApproval": {handler: (*SimpleChaincode).revokeApproval},
+		"allowance": {handler: (*SimpleChaincode).allowance, readOnly: true},
+		"transferFrom": {handler: (*SimpleChaincode).transferFrom, idempotentArgs: 3},
+		// Reserves funds for a later capture, available balance is balance minus open holds
+		"hold": {handler: (*SimpleChaincode).hold, idempotentArgs: 5},
+		"capture": {handler: (*SimpleChaincode).capture, idempotentArgs: 4},
+		"release": {handler: (*SimpleChaincode).release},
+		"holds": {handler: (*SimpleChaincode).holds, readOnly: true},
+		// Transfers escrowed until a release time, anyone may execute the due ones
+		"scheduleMove": {handler: (*SimpleChaincode).scheduleMove, idempotentArgs: 4},
+		"executeDue": {handler: (*SimpleChaincode).executeDue},
+		"cancelSchedule": {handler: (*SimpleChaincode).cancelSchedule},
+		"pendingSchedules": {handler: (*SimpleChaincode).pendingSchedules, readOnly: true},
+		// Assets other than the token and their delivery versus payment exchange
+		"issueAsset": {handler: (*SimpleChaincode).issueAsset, role: "issuer", idempotentArgs: 3, quorum: true},
+		"assetBalance": {handler: (*SimpleChaincode).assetBalance, readOnly: true},
+		"offerSwap": {handler: (*SimpleChaincode).offerSwap, idempotentArgs: 7},
+		"acceptSwap": {handler: (*SimpleChaincode).acceptSwap, idempotentArgs: 2},
+		"cancelSwap": {handler: (*SimpleChaincode).cancelSwap},
+		"swapOffers": {handler: (*SimpleChaincode).swapOffers, readOnly: true},
+		// Account lifecycle: frozen and closed entities take neither debits nor credits
+		"freeze": {handler: (*SimpleChaincode).freeze, role: "admin", quorum: true},
+		"unfreeze": {handler: (*SimpleChaincode).unfreeze, role: "admin", quorum: true},
+		"closeAccount": {handler: (*SimpleChaincode).closeAccount},
+		"restore": {handler: (*SimpleChaincode).restore, role: "admin", quorum: true},
+		"accountStatus": {handler: (*SimpleChaincode).accountStatus, readOnly: true},
+		"accountHistory": {handler: (*SimpleChaincode).accountHistory, readOnly: true},
+		// How long deleted entities can be restored, in seconds
+		"setRestoreRetention": {handler: (*SimpleChaincode).setRestoreRetention, role: "admin", quorum: true},
+		// Personal account of the caller, named after its certificate
+		"myBalance": {handler: (*SimpleChaincode).myBalance, readOnly: true},
+		"pay": {handler: (*SimpleChaincode).pay, idempotentArgs: 2},
+		"setAccountKeyMode": {handler: (*SimpleChaincode).setAccountKeyMode, role: "admin", quorum: true},
+		// Double-entry journal: chart of accounts, balanced entries, period closing and reports
+		"addAccount": {handler: (*SimpleChaincode).addAccount, role: "admin", quorum: true},
+		"chartOfAccounts": {handler: (*SimpleChaincode).chartOfAccounts, readOnly: true},
+		"postJournal": {handler: (*SimpleChaincode).postJournal, role: "accountant", idempotentArgs: 1},
+		"closePeriod": {handler: (*SimpleChaincode).closePeriod, role: "admin", quorum: true},
+		"trialBalance": {handler: (*SimpleChaincode).trialBalance, readOnly: true},
+		"ledgerReport": {handler: (*SimpleChaincode).ledgerReport, readOnly: true},
+		// Outcome of the call made with a client request id
+		"getRequest": {handler: (*SimpleChaincode).getRequest, readOnly: true},
+		// How long client request ids are remembered, in seconds
+		"setRequestRetention": {handler: (*SimpleChaincode).setRequestRetention, role: "admin", quorum: true},
+		// Privileged calls approved by a quorum of orgs, direct until a quorum rule is set
+		"propose": {handler: (*SimpleChaincode).propose, idempotentArgs: 3},
+		"approveProposal": {handler: (*SimpleChaincode).approveProposal},
+		"rejectProposal": {handler: (*SimpleChaincode).rejectProposal},
+		"proposals": {handler: (*SimpleChaincode).proposals, readOnly: true},
+		"setQuorum": {handler: (*SimpleChaincode).setQuorum, role: "admin", quorum: true},
+		// Access policies over the caller identity replacing the role of a function
+		"setPolicy": {handler: (*SimpleChaincode).setPolicy, role: "admin", quorum: true},
+		"evaluatePolicy": {handler: (*SimpleChaincode).evaluatePolicy, readOnly: true},
+		// Typed settings with defaults, the dedicated setters above keep working
+		"getConfig": {handler: (*SimpleChaincode).getConfig, readOnly: true},
+		"setConfig": {handler: (*SimpleChaincode).setConfig, role: "admin", quorum: true},
+		"configHistory": {handler: (*SimpleChaincode).configHistory, readOnly: true},
+		// Sent today and over the rolling window against the velocity limits
+		"limits": {handler: (*SimpleChaincode).limits, readOnly: true},
+		// Emergency stop of every function changing state, a quorum lifts it once a rule is set
+		"pause": {handler: (*SimpleChaincode).pause, role: "admin"},
+		"unpause": {handler: (*SimpleChaincode).unpause, role: "admin", quorum: true},
+		"health": {handler: (*SimpleChaincode).health, readOnly: true},
+		// Amounts encrypted with a key passed in the transient map, see crypt.go
+		"setEncryption": {handler: (*SimpleChaincode).setEncryption, role: "admin", quorum: true},
+		"rotateEncryptionKey": {handler: (*SimpleChaincode).rotateEncryptionKey, role: "admin", quorum: true},
+		"reencrypt": {handler: (*SimpleChaincode).reencrypt, role: "admin"},
+	}
+}
+
 func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
-	logger.Debug("Invoke")
+	function, args := stub.GetFunctionAndParameters()
+	log := newTxLogger(stub, function)
 
-	creatorBytes, err := stub.GetCreator()
+	response := t.invoke(&txStub{stub, log, map[string][]byte{}}, function, args)
+	if response.Status >= shim.ERRORTHRESHOLD {
+		log.Infof("failed with status %d: %s", response.Status, response.Message)
+	} else {
+		log.Debugf("completed with status %d", response.Status)
+	}
+
+	// keep unknown names out of the metric labels
+	if _, ok := functions[function]; !ok {
+		function = "unknown"
+	}
+	metrics.ObserveInvoke(function, response.Status, time.Since(log.Start))
+
+	return response
+}
+
+// invoke checks the caller may call the function and calls it
+func (t *SimpleChaincode) invoke(stub *txStub, function string, args []string) pb.Response {
+	id, err := getCreator(stub)
 	if err != nil {
-		return shim.Error(err.Error())
+		return pb.Response{Status:403, Message:err.Error()}
 	}
+	stub.log.Caller = id.name()
 
-	name, org := getCreator(creatorBytes)
+	stub.log.Debugf("Invoke %v", stub.log.RedactArgs(args))
 
-	logger.Debug("transaction creator " + name + "@" + org)
+	f, ok := functions[function]
+	if !ok {
+		return pb.Response{Status:403, Message:"Invalid invoke function name."}
+	}
+	allowed, requirement, err := id.allowed(stub, function)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !allowed {
+		return pb.Response{Status:403, Message:"Function " + function + " requires " + requirement}
+	}
+	if response := checkPaused(stub, function); response.Status >= shim.ERRORTHRESHOLD {
+		return response
+	}
+	if f.quorum {
+		q, err := getQuorum(stub)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if q != nil {
+			return pb.Response{Status:403, Message:"Function " + function + " requires a proposal approved by " + strconv.Itoa(q.Threshold) + " of " + strings.Join(q.Orgs, ", ")}
+		}
+	}
 
-	function, args := stub.GetFunctionAndParameters()
-	if function == "move" {
-		// Make payment of x units from a to b
-		return t.move(stub, args)
-	} else if function == "delete" {
-		// Deletes an entity from its state
-		return t.delete(stub, args)
-	} else if function == "query" {
-		// the old "Query" is now implemented in invoke
-		return t.query(stub, args)
+	var response pb.Response
+	if f.idempotentArgs > 0 && len(args) == f.idempotentArgs+1 {
+		requestID := args[f.idempotentArgs]
+		args = args[:f.idempotentArgs]
+		response = idempotent(stub, function, requestID, args, func() pb.Response {
+			return f.handler(t, stub, args)
+		})
+	} else {
+		response = f.handler(t, stub, args)
 	}
 
-	return pb.Response{Status:403, Message:"Invalid invoke function name."}
+	// the response of a transaction changing state is written to the ledger with it
+	if f.readOnly {
+		return response
+	}
+	return sealResponse(stub, response)
 }
 
 // Transaction makes payment of x units from a to b
 func (t *SimpleChaincode) move(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	var a, b string    // Entities
-	var aVal, bVal int // Asset holdings
 	var x int          // Transaction value
 	var err error
 
@@ -97,69 +277,111 @@ func (t *SimpleChaincode) move(stub shim.ChaincodeStubInterface, args []string)
 	a = args[0]
 	b = args[1]
 
-	// Get the state from the ledger
-	aBytes, err := stub.GetState(a)
-	if err != nil {
-		return shim.Error(err.Error())
+	// Check the entities exist, their balances are not read so that delta mode stays conflict free
+	for _, entity := range []string{a, b} {
+		found, err := entityExists(stub, entity)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if !found {
+			return shim.Error("Entity not found")
+		}
 	}
-	if aBytes == nil {
-		return shim.Error("Entity not found")
-	}
-	aVal, _ = strconv.Atoi(string(aBytes))
 
-	bBytes, err := stub.GetState(b)
+	// Perform the execution
+	x, err = strconv.Atoi(args[2])
 	if err != nil {
-		return shim.Error("Failed to get state")
+		return pb.Response{Status:403, Message:"Invalid transaction amount, expecting a integer value"}
 	}
-	if bBytes == nil {
-		return shim.Error("Entity not found")
+	if x <= 0 {
+		return pb.Response{Status:403, Message:"Invalid transaction amount, expecting a positive value"}
 	}
-	bVal, _ = strconv.Atoi(string(bBytes))
 
-	// Perform the execution
-	x, err = strconv.Atoi(args[2])
+	// Callers not owning a spend from the allowance a gave them
+	id, err := getCreator(stub)
 	if err != nil {
-		return pb.Response{Status:403, Message:"Invalid transaction amount, expecting a integer value"}
+		return shim.Error(err.Error())
+	}
+	if !id.owns(a) {
+		if response := spendAllowance(stub, a, id.name(), x); response.Status >= shim.ERRORTHRESHOLD {
+			return response
+		}
 	}
-	aVal = aVal - x
-	bVal = bVal + x
-	logger.Debug("aVal = %d, bVal = %d\n", aVal, bVal)
 
-	// Write the state back to the ledger
-	err = stub.PutState(a, []byte(strconv.Itoa(aVal)))
+	// Held funds cannot be moved
+	available, _, err := availableBalance(stub, a, "")
 	if err != nil {
 		return shim.Error(err.Error())
 	}
+	if available < x {
+		return pb.Response{Status:403, Message:"Insufficient funds: " + a + " has " + strconv.Itoa(available) + " available"}
+	}
 
-	err = stub.PutState(b, []byte(strconv.Itoa(bVal)))
+	// Write the state back to the ledger, a and b may be the same entity, b gets x less the fee
+	e, err := itemise(stub, "move", a, b, x)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 
-	return shim.Success(nil)
+	return applyTransfer(stub, e)
 }
 
-// deletes an entity from state
+// deletes an entity from state, leaving a tombstone restore can bring it back from, by its owner
+// or an admin: entity and optional reason
 func (t *SimpleChaincode) delete(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	if len(args) != 1 {
-		return pb.Response{Status:403, Message:"Incorrect number of arguments"}
+	if len(args) != 1 && len(args) != 2 {
+		return pb.Response{Status:403, Message:"Incorrect number of arguments. Expecting entity and optional reason"}
 	}
 
 	a := args[0]
+	reason := ""
+	if len(args) == 2 {
+		reason = args[1]
+	}
 
-	// Delete the key from the state in ledger
-	err := stub.DelState(a)
+	id, err := getCreator(stub)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
+	if !id.owns(a) && !id.hasRole("admin") {
+		return pb.Response{Status:403, Message:"Only the owner of " + a + " or an admin may delete it"}
+	}
 
-	return shim.Success(nil)
+	// Value only leaves the ledger through burn
+	balance, found, err := getBalance(stub, a)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !found {
+		return pb.Response{Status:404, Message:"Entity not found"}
+	}
+	if balance != 0 {
+		return pb.Response{Status:403, Message:"Entity has a non-zero balance"}
+	}
+
+	// Delete the key and its pending deltas from the state in ledger
+	_, keys, err := getDeltas(stub, a)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	for _, key := range append(keys, a) {
+		err = stub.DelState(key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	// The status record stays as the tombstone
+	s, err := getStatus(stub, a)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return setStatus(stub, s, statusDeleted, reason)
 }
 
 // read value
 func (t *SimpleChaincode) query(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	var a string // Entities
-	var err error
 
 	//if len(args) != 1 {
 	//	return pb.Response{Status:403, Message:"Incorrect number of arguments"}
@@ -167,33 +389,135 @@ func (t *SimpleChaincode) query(stub shim.ChaincodeStubInterface, args []string)
 
 	a = args[0]
 
-	// Get the state from the ledger
-	valBytes, err := stub.GetState(a)
+	// Get the state and pending deltas from the ledger
+	val, found, err := getBalance(stub, a)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 
-	if valBytes == nil {
+	if !found {
 		return shim.Error("Entity not found")
 	}
 
-	return shim.Success(valBytes)
+	return shim.Success([]byte(strconv.Itoa(val)))
+}
+
+// folds pending deltas of the given entities into their balances
+func (t *SimpleChaincode) compact(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) == 0 {
+		return pb.Response{Status:403, Message:"Incorrect number of arguments. Expecting entities to compact"}
+	}
+
+	compacted := map[string]int{}
+	for _, a := range args {
+		n, err := compactEntity(stub, a)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		compacted[a] = n
+	}
+
+	compactedBytes, err := json.Marshal(compacted)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(compactedBytes)
+}
+
+// switches delta mode on or off, pending deltas keep counting in balances either way
+func (t *SimpleChaincode) setDeltaMode(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return pb.Response{Status:403, Message:"Incorrect number of arguments. Expecting true or false"}
+	}
+
+	return changeConfig(stub, "deltaMode", args[0])
+}
+
+// returns the recorded outcome of a call the caller made with a client request id
+func (t *SimpleChaincode) getRequest(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return pb.Response{Status:403, Message:"Incorrect number of arguments. Expecting request id"}
+	}
+
+	id, err := getCreator(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	record, err := getRequest(stub, id.name(), args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if record == nil {
+		return pb.Response{Status:404, Message:"Request not found"}
+	}
+
+	recordBytes, err := json.Marshal(record)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(recordBytes)
+}
+
+func (t *SimpleChaincode) setRequestRetention(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return pb.Response{Status:403, Message:"Incorrect number of arguments. Expecting retention in seconds"}
+	}
+
+	return changeConfig(stub, "requestRetention", args[0])
+}
+
+// getCreator resolves the identity of the transaction creator
+var getCreator = func (stub shim.ChaincodeStubInterface) (*identity, error) {
+	creatorBytes, err := stub.GetCreator()
+	if err != nil {
+		return nil, err
+	}
+	return parseCreator(creatorBytes)
 }
 
-var getCreator = func (certificate []byte) (string, string) {
-	data := certificate[strings.Index(string(certificate), "-----"): strings.LastIndex(string(certificate), "-----")+5]
-	block, _ := pem.Decode([]byte(data))
-	cert, _ := x509.ParseCertificate(block.Bytes)
-	organization := cert.Issuer.Organization[0]
-	commonName := cert.Subject.CommonName
-	logger.Debug("commonName: " + commonName + ", organization: " + organization)
+// describes the transaction creator: identity, certificate, roles and permitted functions
+func (t *SimpleChaincode) whoami(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	id, err := getCreator(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	permissions, err := id.permissions(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	whoami := struct {
+		*identity
+		Roles       []string `json:"roles"`
+		Permissions []string `json:"permissions"`
+	}{id, id.roles(), permissions}
+
+	whoamiBytes, err := json.Marshal(whoami)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(whoamiBytes)
+}
 
-	organizationShort := strings.Split(organization, ".")[0]
+// stores the logging settings applied from the next transaction on
+func (t *SimpleChaincode) setLogging(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return pb.Response{Status:403, Message:"Incorrect number of arguments. Expecting logging config as json"}
+	}
 
-	return commonName, organizationShort
+	return changeConfig(stub, "logging", args[0])
 }
 
 func main() {
+	// lines are filtered per transaction by observability.TxLogger
+	logger.SetLevel(shim.LogDebug)
+
+	metrics.Serve(logger)
+
 	err := shim.Start(new(SimpleChaincode))
 	if err != nil {
 		logger.Error(err.Error())
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Settings live under composite keys config~name so they never clash with entity names. Every
+// setting is declared in the settings table with its type, its default and a check of new values;
+// changes go through changeConfig, which validates them and sends them as setConfig event, and the
+// history of a setting is the history of its key. Values read during a transaction are cached by
+// the txStub, so handlers may read them as often as they need.
+const configObjectType = "config"
+
+const (
+	settingString = "string"
+	settingInt    = "int"
+	settingBool   = "bool"
+	settingJSON   = "json"
+)
+
+// setting declares a config key
+type setting struct {
+	kind        string
+	def         string // value of the setting while it is not set
+	description string
+	// function whose access policy also applies to changes made through setConfig
+	setter string
+	// check validates a value of the right type and returns it the way it is stored
+	check func(stub shim.ChaincodeStubInterface, name, value string) (string, error)
+}
+
+// settings are the config keys of the chaincode, settingPrefixes those with one key per suffix
+var settings, settingPrefixes map[string]setting
+
+func init() {
+	tokenBytes, _ := json.Marshal(defaultTokenInfo)
+	settings = map[string]setting{
+		"logging": {kind: settingJSON, description: "level, format and argument redaction of the chaincode log",
+			setter: "setLogging", check: checkLogConfig},
+		"deltaMode": {kind: settingBool, def: "false", description: "balance changes written as delta keys",
+			setter: "setDeltaMode"},
+		"requestRetention": {kind: settingInt, def: strconv.Itoa(defaultRequestRetention), description: "seconds client request ids are remembered",
+			setter: "setRequestRetention", check: checkNonNegative},
+		"restoreRetention": {kind: settingInt, def: strconv.Itoa(defaultRestoreRetention), description: "seconds deleted entities can be restored",
+			setter: "setRestoreRetention", check: checkNonNegative},
+		"token": {kind: settingJSON, def: string(tokenBytes), description: "name, symbol and decimals of the token",
+			setter: "setTokenInfo", check: checkTokenInfo},
+		"accountKeyMode": {kind: settingString, def: accountKeyName, description: "how personal accounts are named, name or certHash",
+			setter: "setAccountKeyMode", check: checkAccountKeyMode},
+		"feeCollector": {kind: settingString, def: "fees", description: "entity credited with the fees of schedules naming no collector"},
+		"pause": {kind: settingJSON, description: "reason, author and time of the pause stopping functions changing state",
+			setter: "pause", check: checkPauseState},
+		"encryption": {kind: settingJSON, description: "id of the key amounts are encrypted with, plain amounts when not set",
+			setter: "setEncryption", check: checkEncryptionState},
+		"quorum": {kind: settingJSON, description: "orgs and threshold approving privileged calls",
+			setter: "setQuorum", check: checkQuorum},
+	}
+	settingPrefixes = map[string]setting{
+		policyConfigPrefix: {kind: settingString, description: "access policy of a function",
+			setter: "setPolicy", check: checkPolicy},
+		feeConfigPrefix: {kind: settingJSON, description: "fee schedule of a function, for one asset when suffixed with :<asset>",
+			check: checkFeeSchedule},
+		limitConfigPrefix: {kind: settingJSON, description: "velocity limit of account:<entity> or org:<org>, of every account or org without suffix",
+			check: checkVelocityLimit},
+	}
+}
+
+func lookupSetting(name string) (setting, bool) {
+	if s, ok := settings[name]; ok {
+		return s, true
+	}
+	for prefix, s := range settingPrefixes {
+		if strings.HasPrefix(name, prefix) && len(name) > len(prefix) {
+			return s, true
+		}
+	}
+	return setting{}, false
+}
+
+// configCache is the cache of the transaction, nil outside of Invoke
+func configCache(stub shim.ChaincodeStubInterface) map[string][]byte {
+	if ts, ok := stub.(*txStub); ok {
+		return ts.config
+	}
+	return nil
+}
+
+func getConfig(stub shim.ChaincodeStubInterface, name string) ([]byte, error) {
+	cache := configCache(stub)
+	if value, ok := cache[name]; ok {
+		return value, nil
+	}
+	key, err := stub.CreateCompositeKey(configObjectType, []string{name})
+	if err != nil {
+		return nil, err
+	}
+	value, err := stub.GetState(key)
+	if err == nil && cache != nil {
+		cache[name] = value
+	}
+	return value, err
+}
+
+func putConfig(stub shim.ChaincodeStubInterface, name string, value []byte) error {
+	key, err := stub.CreateCompositeKey(configObjectType, []string{name})
+	if err != nil {
+		return err
+	}
+	if cache := configCache(stub); cache != nil {
+		cache[name] = value
+	}
+	return stub.PutState(key, value)
+}
+
+func delConfig(stub shim.ChaincodeStubInterface, name string) error {
+	key, err := stub.CreateCompositeKey(configObjectType, []string{name})
+	if err != nil {
+		return err
+	}
+	if cache := configCache(stub); cache != nil {
+		cache[name] = nil
+	}
+	return stub.DelState(key)
+}
+
+// configValue returns the value of a setting, its default while it is not set
+func configValue(stub shim.ChaincodeStubInterface, name string) (string, error) {
+	value, err := getConfig(stub, name)
+	if err != nil {
+		return "", err
+	}
+	if value == nil {
+		s, _ := lookupSetting(name)
+		return s.def, nil
+	}
+	return string(value), nil
+}
+
+func configInt(stub shim.ChaincodeStubInterface, name string) (int64, error) {
+	value, err := configValue(stub, name)
+	if err != nil || value == "" {
+		return 0, err
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
+
+func configBool(stub shim.ChaincodeStubInterface, name string) (bool, error) {
+	value, err := configValue(stub, name)
+	if err != nil || value == "" {
+		return false, err
+	}
+	return strconv.ParseBool(value)
+}
+
+// configJSON decodes a json setting into v, found is false when it has neither value nor default
+func configJSON(stub shim.ChaincodeStubInterface, name string, v interface{}) (found bool, err error) {
+	value, err := configValue(stub, name)
+	if err != nil || value == "" {
+		return false, err
+	}
+	return true, json.Unmarshal([]byte(value), v)
+}
+
+// validateSetting checks the type of a value and its setting specific rules, returning it the way it is stored
+func validateSetting(stub shim.ChaincodeStubInterface, name, value string) (string, error) {
+	s, ok := lookupSetting(name)
+	if !ok {
+		return "", fmt.Errorf("unknown setting %s", name)
+	}
+	switch s.kind {
+	case settingInt:
+		i, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("%s expects an integer", name)
+		}
+		value = strconv.FormatInt(i, 10)
+	case settingBool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return "", fmt.Errorf("%s expects true or false", name)
+		}
+		value = strconv.FormatBool(b)
+	case settingJSON:
+		if !json.Valid([]byte(value)) {
+			return "", fmt.Errorf("%s expects json", name)
+		}
+	}
+	if s.check == nil {
+		return value, nil
+	}
+	return s.check(stub, name, value)
+}
+
+func checkNonNegative(stub shim.ChaincodeStubInterface, name, value string) (string, error) {
+	if strings.HasPrefix(value, "-") {
+		return "", fmt.Errorf("%s expects a non negative number of seconds", name)
+	}
+	return value, nil
+}
+
+type configChange struct {
+	Name      string `json:"name"`
+	Previous  string `json:"previous,omitempty"`
+	Value     string `json:"value,omitempty"` // empty when the setting reverted to its default
+	ChangedBy string `json:"changedBy"`
+	TxID      string `json:"txId"`
+}
+
+// changeConfig validates and stores the new value of a setting, empty to revert it to its default,
+// and sends the change as the event of the transaction
+func changeConfig(stub shim.ChaincodeStubInterface, name, value string) pb.Response {
+	var err error
+	if value != "" {
+		if value, err = validateSetting(stub, name, value); err != nil {
+			return pb.Response{Status: 403, Message: err.Error()}
+		}
+	} else if _, ok := lookupSetting(name); !ok {
+		return pb.Response{Status: 403, Message: "unknown setting " + name}
+	}
+
+	id, err := getCreator(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	previous, err := getConfig(stub, name)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	change := &configChange{Name: name, Previous: string(previous), Value: value, ChangedBy: id.name(), TxID: stub.GetTxID()}
+
+	if value == "" {
+		err = delConfig(stub, name)
+	} else {
+		err = putConfig(stub, name, []byte(value))
+	}
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	changeBytes, err := json.Marshal(change)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err = stub.SetEvent("setConfig", changeBytes); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(changeBytes)
+}
+
+type settingView struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Description string `json:"description"`
+	Default     string `json:"default,omitempty"`
+	Value       string `json:"value"`
+	Set         bool   `json:"set"` // false when the value is the default
+}
+
+func viewSetting(stub shim.ChaincodeStubInterface, name string) (*settingView, error) {
+	s, _ := lookupSetting(name)
+	value, err := getConfig(stub, name)
+	if err != nil {
+		return nil, err
+	}
+	v := &settingView{Name: name, Type: s.kind, Description: s.description, Default: s.def, Value: s.def}
+	if value != nil {
+		v.Value, v.Set = string(value), true
+	}
+	return v, nil
+}
+
+// settings with their type, default and current value: optional setting name
+func (t *SimpleChaincode) getConfig(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) > 1 {
+		return pb.Response{Status: 403, Message: "Incorrect number of arguments. Expecting optional setting name"}
+	}
+
+	var result interface{}
+	if len(args) == 1 && args[0] != "" {
+		if _, ok := lookupSetting(args[0]); !ok {
+			return pb.Response{Status: 404, Message: "Setting " + args[0] + " not found"}
+		}
+		v, err := viewSetting(stub, args[0])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		result = v
+	} else {
+		// the declared settings and the prefixed ones that are set
+		names := []string{}
+		for name := range settings {
+			names = append(names, name)
+		}
+		it, err := stub.GetStateByPartialCompositeKey(configObjectType, []string{})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		defer it.Close()
+		for it.HasNext() {
+			kv, err := it.Next()
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			_, attributes, err := stub.SplitCompositeKey(kv.Key)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			if _, declared := settings[attributes[0]]; !declared {
+				if _, ok := lookupSetting(attributes[0]); ok {
+					names = append(names, attributes[0])
+				}
+			}
+		}
+		sort.Strings(names)
+
+		views := []*settingView{}
+		for _, name := range names {
+			v, err := viewSetting(stub, name)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			views = append(views, v)
+		}
+		result = views
+	}
+
+	resultBytes, err := json.Marshal(result)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(resultBytes)
+}
+
+// changes a setting, an empty value reverts it to its default: setting name and value
+func (t *SimpleChaincode) setConfig(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		return pb.Response{Status: 403, Message: "Incorrect number of arguments. Expecting setting name and value"}
+	}
+
+	s, ok := lookupSetting(args[0])
+	if !ok {
+		return pb.Response{Status: 404, Message: "Setting " + args[0] + " not found"}
+	}
+	// setConfig is no way around the access policy of the function owning the setting
+	if s.setter != "" {
+		id, err := getCreator(stub)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		allowed, requirement, err := id.allowed(stub, s.setter)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if !allowed {
+			return pb.Response{Status: 403, Message: "Setting " + args[0] + " requires " + requirement}
+		}
+	}
+
+	return changeConfig(stub, args[0], args[1])
+}
+
+// the values a setting had, oldest first: setting name
+func (t *SimpleChaincode) configHistory(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return pb.Response{Status: 403, Message: "Incorrect number of arguments. Expecting setting name"}
+	}
+
+	key, err := stub.CreateCompositeKey(configObjectType, []string{args[0]})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	it, err := stub.GetHistoryForKey(key)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer it.Close()
+
+	type change struct {
+		TxID      string `json:"txId"`
+		Timestamp int64  `json:"timestamp,omitempty"`
+		Value     string `json:"value,omitempty"`
+		Deleted   bool   `json:"deleted,omitempty"`
+	}
+	history := []change{}
+	for it.HasNext() {
+		modification, err := it.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		c := change{TxID: modification.TxId, Value: string(modification.Value), Deleted: modification.IsDelete}
+		if modification.Timestamp != nil {
+			c.Timestamp = modification.Timestamp.Seconds
+		}
+		history = append(history, c)
+	}
+
+	historyBytes, err := json.Marshal(history)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(historyBytes)
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// In encryption mode amounts are written to the state as AES-256-GCM ciphertext: balances, deltas,
+// asset balances and velocity totals, and as a whole the json records holding amounts, see
+// sealedObjectTypes. The 32 byte key travels in the transient field "encryptionKey" of every
+// proposal reading or writing them, so it never lands on the ledger; the "encryption" setting only
+// records the id of the key, the first 8 bytes of its SHA-256. A value is enc:<key id>:<base64 of
+// nonce and ciphertext>, sealed with the state key as additional data so that it cannot be moved
+// to another key. The nonce is derived from the key, the transaction and the state key, every
+// endorser writes the same ciphertext. After a rotation values stay under the previous key, passed
+// as "previousEncryptionKey", until reencrypt rewrites them and, finding none left, retires it; the
+// key cannot be rotated again before. Plain values written before the mode was switched on stay
+// readable.
+//
+// Events and the responses of functions changing state end up in the block as well, so they are
+// sealed the same way, with "\x00event\x00<name>" and "\x00response\x00" as additional data.
+// Read-only functions answer in plain to the caller, who passed the key to read the amounts.
+const (
+	encryptionKeyField         = "encryptionKey"
+	previousEncryptionKeyField = "previousEncryptionKey"
+	encryptedPrefix            = "enc:"
+)
+
+// sealedObjectTypes are the composite key types whose json records hold amounts
+var sealedObjectTypes = map[string]bool{
+	allowanceObjectType: true,
+	holdObjectType:      true,
+	scheduleObjectType:  true,
+	swapObjectType:      true,
+	requestObjectType:   true,
+	proposalObjectType:  true,
+	supplyObjectType:    true,
+	entryObjectType:     true,
+	postingObjectType:   true,
+	totalObjectType:     true,
+}
+
+// additional data of sealed events and responses, no state key starts with it
+const (
+	eventLabel    = "\x00event\x00"
+	responseLabel = "\x00response\x00"
+)
+
+// encryptionState is kept under the "encryption" config key
+type encryptionState struct {
+	KeyID         string `json:"keyId"`
+	PreviousKeyID string `json:"previousKeyId,omitempty"`
+}
+
+func keyID(key []byte) string {
+	h := sha256.Sum256(key)
+	return hex.EncodeToString(h[:8])
+}
+
+// transientKey returns the key passed in a transient field, nil when there is none
+func transientKey(stub shim.ChaincodeStubInterface, field string) ([]byte, error) {
+	transient, err := stub.GetTransient()
+	if err != nil {
+		return nil, err
+	}
+	key, ok := transient[field]
+	if !ok {
+		return nil, nil
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("%s must be 32 bytes for AES-256", field)
+	}
+	return key, nil
+}
+
+// encryptionKeyByID finds the key of the given id among those of the transient map
+func encryptionKeyByID(stub shim.ChaincodeStubInterface, id string) ([]byte, error) {
+	for _, field := range []string{encryptionKeyField, previousEncryptionKeyField} {
+		key, err := transientKey(stub, field)
+		if err != nil {
+			return nil, err
+		}
+		if key != nil && keyID(key) == id {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("encryption key %s missing from the transient map", id)
+}
+
+func getEncryption(stub shim.ChaincodeStubInterface) (*encryptionState, error) {
+	e := &encryptionState{}
+	found, err := configJSON(stub, "encryption", e)
+	if err != nil || !found {
+		return nil, err
+	}
+	return e, nil
+}
+
+func checkEncryptionState(stub shim.ChaincodeStubInterface, name, value string) (string, error) {
+	e := &encryptionState{}
+	if err := json.Unmarshal([]byte(value), e); err != nil {
+		return "", fmt.Errorf("invalid encryption: %s", err)
+	}
+	// a key id nobody holds the key of would lock every amount
+	if _, err := encryptionKeyByID(stub, e.KeyID); err != nil {
+		return "", err
+	}
+	stateBytes, err := json.Marshal(e)
+	return string(stateBytes), err
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealValue returns the value the way it is written under the state key
+func sealValue(stub shim.ChaincodeStubInterface, stateKey string, plain []byte) ([]byte, error) {
+	e, err := getEncryption(stub)
+	if err != nil || e == nil {
+		return plain, err
+	}
+	key, err := encryptionKeyByID(stub, e.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(stub.GetTxID() + "\x00" + stateKey))
+	nonce := mac.Sum(nil)[:gcm.NonceSize()]
+	sealed := gcm.Seal(nonce, nonce, plain, []byte(stateKey))
+
+	return []byte(encryptedPrefix + e.KeyID + ":" + base64.StdEncoding.EncodeToString(sealed)), nil
+}
+
+// openValue reads a value written under the state key, plain or encrypted
+func openValue(stub shim.ChaincodeStubInterface, stateKey string, value []byte) ([]byte, error) {
+	if !strings.HasPrefix(string(value), encryptedPrefix) {
+		return value, nil
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(string(value), encryptedPrefix), ":", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("malformed encrypted value of %s", stateKey)
+	}
+	key, err := encryptionKeyByID(stub, parts[0])
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed encrypted value of %s", stateKey)
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, fmt.Errorf("malformed encrypted value of %s", stateKey)
+	}
+	plain, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], []byte(stateKey))
+	if err != nil {
+		return nil, fmt.Errorf("cannot decrypt %s: %s", stateKey, err)
+	}
+	return plain, nil
+}
+
+// sealAmount returns the amount the way it is written under the state key
+func sealAmount(stub shim.ChaincodeStubInterface, stateKey string, amount int) ([]byte, error) {
+	return sealValue(stub, stateKey, []byte(strconv.Itoa(amount)))
+}
+
+// openAmount reads an amount written under the state key, plain or encrypted
+func openAmount(stub shim.ChaincodeStubInterface, stateKey string, value []byte) (int, error) {
+	plain, err := openValue(stub, stateKey, value)
+	if err != nil {
+		return 0, err
+	}
+	amount, _ := strconv.Atoi(string(plain))
+	return amount, nil
+}
+
+// readAmount reads the amount of a state key, found is false when the key does not exist
+func readAmount(stub shim.ChaincodeStubInterface, stateKey string) (amount int, found bool, err error) {
+	value, err := stub.GetState(stateKey)
+	if err != nil || value == nil {
+		return 0, false, err
+	}
+	amount, err = openAmount(stub, stateKey, value)
+	return amount, err == nil, err
+}
+
+func writeAmount(stub shim.ChaincodeStubInterface, stateKey string, amount int) error {
+	value, err := sealAmount(stub, stateKey, amount)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(stateKey, value)
+}
+
+// SetEvent seals the payload of the event of the transaction
+func (s *txStub) SetEvent(name string, payload []byte) error {
+	sealed, err := sealValue(s, eventLabel+name, payload)
+	if err != nil {
+		return err
+	}
+	return s.ChaincodeStubInterface.SetEvent(name, sealed)
+}
+
+// sealResponse seals the payload of a successful response
+func sealResponse(stub shim.ChaincodeStubInterface, response pb.Response) pb.Response {
+	if response.Status >= shim.ERRORTHRESHOLD || len(response.Payload) == 0 {
+		return response
+	}
+	sealed, err := sealValue(stub, responseLabel, response.Payload)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	response.Payload = sealed
+	return response
+}
+
+// current tells whether a value is written the way the encryption mode writes it now
+func (e *encryptionState) current(value []byte) bool {
+	if e == nil {
+		return !strings.HasPrefix(string(value), encryptedPrefix)
+	}
+	return strings.HasPrefix(string(value), encryptedPrefix+e.KeyID+":")
+}
+
+// switches encryption of amounts on with the key of the transient map, or off: true or false
+func (t *SimpleChaincode) setEncryption(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return pb.Response{Status: 403, Message: "Incorrect number of arguments. Expecting true or false"}
+	}
+	on, err := strconv.ParseBool(args[0])
+	if err != nil {
+		return pb.Response{Status: 403, Message: "Expecting true or false"}
+	}
+
+	e, err := getEncryption(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !on {
+		if e == nil {
+			return pb.Response{Status: 409, Message: "Encryption is off"}
+		}
+		return changeConfig(stub, "encryption", "")
+	}
+	if e != nil {
+		return pb.Response{Status: 409, Message: "Encryption is on, rotate the key with rotateEncryptionKey"}
+	}
+
+	key, err := transientKey(stub, encryptionKeyField)
+	if err != nil {
+		return pb.Response{Status: 403, Message: err.Error()}
+	}
+	if key == nil {
+		return pb.Response{Status: 403, Message: "Expecting the key in the transient field " + encryptionKeyField}
+	}
+	stateBytes, err := json.Marshal(&encryptionState{KeyID: keyID(key)})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return changeConfig(stub, "encryption", string(stateBytes))
+}
+
+// writes new amounts under the key of the transient field encryptionKey, the current key being
+// passed as previousEncryptionKey until reencrypt rewrote every value
+func (t *SimpleChaincode) rotateEncryptionKey(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	e, err := getEncryption(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if e == nil {
+		return pb.Response{Status: 409, Message: "Encryption is off"}
+	}
+	// only two keys can be passed, values left under the previous one would be lost
+	if e.PreviousKeyID != "" {
+		return pb.Response{Status: 409, Message: "Values under the previous key " + e.PreviousKeyID + " remain, run reencrypt until none does"}
+	}
+
+	key, err := transientKey(stub, encryptionKeyField)
+	if err != nil {
+		return pb.Response{Status: 403, Message: err.Error()}
+	}
+	previous, err := transientKey(stub, previousEncryptionKeyField)
+	if err != nil {
+		return pb.Response{Status: 403, Message: err.Error()}
+	}
+	if key == nil || previous == nil || keyID(previous) != e.KeyID {
+		return pb.Response{Status: 403, Message: "Expecting the new key in " + encryptionKeyField + " and key " + e.KeyID + " in " + previousEncryptionKeyField}
+	}
+	if keyID(key) == e.KeyID {
+		return pb.Response{Status: 409, Message: "Key " + e.KeyID + " is already in use"}
+	}
+	stateBytes, err := json.Marshal(&encryptionState{KeyID: keyID(key), PreviousKeyID: e.KeyID})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return changeConfig(stub, "encryption", string(stateBytes))
+}
+
+// rewrites amounts written under a previous key or mode the way the encryption mode writes them
+// now, at most the given number when one is given, and retires the previous key once none remains
+func (t *SimpleChaincode) reencrypt(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) > 1 {
+		return pb.Response{Status: 403, Message: "Incorrect number of arguments. Expecting optional maximum number of values"}
+	}
+
+	limit := 0
+	if len(args) == 1 && args[0] != "" {
+		var err error
+		if limit, err = parseAmount(args[0]); err != nil {
+			return pb.Response{Status: 403, Message: err.Error()}
+		}
+	}
+	e, err := getEncryption(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	progress := struct {
+		Reencrypted  int    `json:"reencrypted"`
+		Remaining    int    `json:"remaining"`
+		RetiredKeyID string `json:"retiredKeyId,omitempty"`
+	}{}
+
+	rewrite := func(it shim.StateQueryIteratorInterface) error {
+		defer it.Close()
+		for it.HasNext() {
+			kv, err := it.Next()
+			if err != nil {
+				return err
+			}
+			if e.current(kv.Value) {
+				continue
+			}
+			if limit > 0 && progress.Reencrypted == limit {
+				progress.Remaining++
+				continue
+			}
+			plain, err := openValue(stub, kv.Key, kv.Value)
+			if err != nil {
+				return err
+			}
+			value, err := sealValue(stub, kv.Key, plain)
+			if err != nil {
+				return err
+			}
+			if err = stub.PutState(kv.Key, value); err != nil {
+				return err
+			}
+			progress.Reencrypted++
+		}
+		return nil
+	}
+
+	// balance keys are the simple keys, the other amounts live under composite keys
+	it, err := stub.GetStateByRange("", "")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err = rewrite(it); err != nil {
+		return shim.Error(err.Error())
+	}
+	records := make([]string, 0, len(sealedObjectTypes))
+	for objectType := range sealedObjectTypes {
+		records = append(records, objectType)
+	}
+	sort.Strings(records)
+	for _, objectType := range append([]string{deltaObjectType, assetObjectType, velocityObjectType}, records...) {
+		it, err := stub.GetStateByPartialCompositeKey(objectType, []string{})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if err = rewrite(it); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	if e != nil && e.PreviousKeyID != "" && progress.Remaining == 0 {
+		stateBytes, err := json.Marshal(&encryptionState{KeyID: e.KeyID})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if response := changeConfig(stub, "encryption", string(stateBytes)); response.Status >= shim.ERRORTHRESHOLD {
+			return response
+		}
+		progress.RetiredKeyID = e.PreviousKeyID
+	}
+
+	progressBytes, err := json.Marshal(progress)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(progressBytes)
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+var (
+	testKey1 = bytes.Repeat([]byte{1}, 32)
+	testKey2 = bytes.Repeat([]byte{2}, 32)
+	testKey3 = bytes.Repeat([]byte{3}, 32)
+)
+
+func encryptedLedger(state encryptionState) *mockLedger {
+	l := newMockLedger()
+	stateBytes, _ := json.Marshal(state)
+	l.setConfig("encryption", string(stateBytes))
+	return l
+}
+
+func withKeys(tx *mockTx, current, previous []byte) *mockTx {
+	tx.transient = map[string][]byte{}
+	if current != nil {
+		tx.transient[encryptionKeyField] = current
+	}
+	if previous != nil {
+		tx.transient[previousEncryptionKeyField] = previous
+	}
+	return tx
+}
+
+func TestSealAmountPlain(t *testing.T) {
+	tx := newMockLedger().tx("tx1", nil)
+	value, err := sealAmount(tx, "a", 42)
+	if err != nil || string(value) != "42" {
+		t.Fatalf("sealAmount without encryption = %q, %v", value, err)
+	}
+	if amount, err := openAmount(tx, "a", value); err != nil || amount != 42 {
+		t.Errorf("openAmount = %d, %v", amount, err)
+	}
+}
+
+func TestSealAmountRoundTrip(t *testing.T) {
+	l := encryptedLedger(encryptionState{KeyID: keyID(testKey1)})
+
+	for _, amount := range []int{0, 1, 42, -7, 1 << 40} {
+		tx := withKeys(l.tx("tx1", nil), testKey1, nil)
+		value, err := sealAmount(tx, "a", amount)
+		if err != nil {
+			t.Fatalf("sealAmount(%d): %s", amount, err)
+		}
+		if !strings.HasPrefix(string(value), encryptedPrefix+keyID(testKey1)+":") {
+			t.Fatalf("sealAmount(%d) = %q, expected it sealed under key %s", amount, value, keyID(testKey1))
+		}
+		if got, err := openAmount(tx, "a", value); err != nil || got != amount {
+			t.Errorf("openAmount(sealAmount(%d)) = %d, %v", amount, got, err)
+		}
+
+		// every endorser of the transaction writes the same ciphertext, other transactions another
+		again, _ := sealAmount(withKeys(l.tx("tx1", nil), testKey1, nil), "a", amount)
+		other, _ := sealAmount(withKeys(l.tx("tx2", nil), testKey1, nil), "a", amount)
+		if !bytes.Equal(value, again) || bytes.Equal(value, other) {
+			t.Errorf("sealAmount(%d) not deterministic per transaction: %q %q %q", amount, value, again, other)
+		}
+	}
+}
+
+func TestOpenAmountFailures(t *testing.T) {
+	l := encryptedLedger(encryptionState{KeyID: keyID(testKey1)})
+	tx := withKeys(l.tx("tx1", nil), testKey1, nil)
+	value, err := sealAmount(tx, "a", 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = openAmount(tx, "b", value); err == nil {
+		t.Error("value moved to another state key opened")
+	}
+	tampered := []byte(string(value[:len(value)-4]) + "AAA=")
+	if _, err = openAmount(tx, "a", tampered); err == nil {
+		t.Error("tampered value opened")
+	}
+	if _, err = openAmount(tx, "a", []byte(encryptedPrefix+"nokeyid")); err == nil {
+		t.Error("malformed value opened")
+	}
+
+	noKey := l.tx("tx2", nil)
+	if _, err = openAmount(noKey, "a", value); err == nil || !strings.Contains(err.Error(), "missing from the transient map") {
+		t.Errorf("openAmount without the key: %v", err)
+	}
+	if _, err = sealAmount(noKey, "a", 42); err == nil {
+		t.Error("sealAmount without the key succeeded")
+	}
+	wrongKey := withKeys(l.tx("tx3", nil), testKey2, nil)
+	if _, err = openAmount(wrongKey, "a", value); err == nil {
+		t.Error("value opened without its key")
+	}
+}
+
+func TestSealAmountKeyRotation(t *testing.T) {
+	before := encryptedLedger(encryptionState{KeyID: keyID(testKey1)})
+	old, err := sealAmount(withKeys(before.tx("tx1", nil), testKey1, nil), "a", 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	after := encryptedLedger(encryptionState{KeyID: keyID(testKey2), PreviousKeyID: keyID(testKey1)})
+	tx := withKeys(after.tx("tx2", nil), testKey2, testKey1)
+	if amount, err := openAmount(tx, "a", old); err != nil || amount != 42 {
+		t.Errorf("value of the previous key after the rotation: %d, %v", amount, err)
+	}
+	rotated, err := sealAmount(tx, "a", 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(rotated), encryptedPrefix+keyID(testKey2)+":") {
+		t.Errorf("value written after the rotation not under the new key: %q", rotated)
+	}
+
+	// once everything is reencrypted the previous key is no longer needed
+	newOnly := withKeys(after.tx("tx3", nil), testKey2, nil)
+	if amount, err := openAmount(newOnly, "a", rotated); err != nil || amount != 42 {
+		t.Errorf("reencrypted value: %d, %v", amount, err)
+	}
+	if _, err = openAmount(newOnly, "a", old); err == nil {
+		t.Error("value of the previous key opened without it")
+	}
+}
+
+func TestRotationWaitsForReencrypt(t *testing.T) {
+	l := encryptedLedger(encryptionState{KeyID: keyID(testKey1)})
+	admin := testCreator(t, "admin", "a", "admin")
+	seed := withKeys(l.tx("seed", admin), testKey1, nil)
+	for _, entity := range []string{"a", "b"} {
+		value, err := sealAmount(seed, entity, 42)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.put(entity, value)
+	}
+	cc := new(SimpleChaincode)
+	run := func(txID string, current, previous []byte, args ...string) pb.Response {
+		tx := withKeys(l.tx(txID, admin, args...), current, previous)
+		response := tx.invoke(cc)
+		l.commit([]*mockTx{tx})
+		return response
+	}
+
+	if response := run("rotate1", testKey2, testKey1, "rotateEncryptionKey"); response.Status != 200 {
+		t.Fatalf("rotateEncryptionKey: status %d %s", response.Status, response.Message)
+	}
+	// b is still under key 1, a third key would leave it unreadable
+	run("reencrypt1", testKey2, testKey1, "reencrypt", "1")
+	if response := run("rotate2", testKey3, testKey2, "rotateEncryptionKey"); response.Status != 409 {
+		t.Fatalf("rotateEncryptionKey with values under the previous key: status %d %s", response.Status, response.Message)
+	}
+
+	response := run("reencrypt2", testKey2, testKey1, "reencrypt")
+	tx := withKeys(l.tx("open", admin), testKey2, nil)
+	progress, err := openValue(tx, responseLabel, response.Payload)
+	if err != nil || !strings.Contains(string(progress), `"remaining":0,"retiredKeyId":"`+keyID(testKey1)+`"`) {
+		t.Fatalf("reencrypt: status %d %s %q, %v", response.Status, response.Message, progress, err)
+	}
+	if e, err := getEncryption(tx); err != nil || e.KeyID != keyID(testKey2) || e.PreviousKeyID != "" {
+		t.Fatalf("encryption after reencrypt: %+v, %v", e, err)
+	}
+
+	if response := run("rotate3", testKey3, testKey2, "rotateEncryptionKey"); response.Status != 200 {
+		t.Fatalf("rotateEncryptionKey once reencrypted: status %d %s", response.Status, response.Message)
+	}
+	query := withKeys(l.tx("query", admin, "query", "b"), testKey3, testKey2)
+	if balance := string(query.invoke(cc).Payload); balance != "42" {
+		t.Errorf("query after two rotations: %q", balance)
+	}
+}
+
+func TestPutJSONSealsRecords(t *testing.T) {
+	l := encryptedLedger(encryptionState{KeyID: keyID(testKey1)})
+	tx := withKeys(l.tx("tx1", nil), testKey1, nil)
+
+	h := &hold{Entity: "a", ID: "h1", Amount: 42}
+	if err := putJSON(tx, holdObjectType, []string{h.Entity, h.ID}, h); err != nil {
+		t.Fatal(err)
+	}
+	key, _ := tx.CreateCompositeKey(holdObjectType, []string{h.Entity, h.ID})
+	value := tx.writes[key]
+	if !strings.HasPrefix(string(value), encryptedPrefix) || strings.Contains(string(value), `"amount"`) {
+		t.Fatalf("hold written in plain: %q", value)
+	}
+	var got hold
+	if err := openJSON(tx, key, value, &got); err != nil || got.Amount != 42 {
+		t.Errorf("openJSON = %+v, %v", got, err)
+	}
+
+	// records without amounts stay readable without the key
+	if err := putJSON(tx, statusObjectType, []string{"a"}, map[string]string{"status": "active"}); err != nil {
+		t.Fatal(err)
+	}
+	statusKey, _ := tx.CreateCompositeKey(statusObjectType, []string{"a"})
+	if strings.HasPrefix(string(tx.writes[statusKey]), encryptedPrefix) {
+		t.Errorf("status record sealed: %q", tx.writes[statusKey])
+	}
+}
+
+func TestEventsAndResponsesSealed(t *testing.T) {
+	l := encryptedLedger(encryptionState{KeyID: keyID(testKey1)})
+	creator := testCreator(t, "user0", "a")
+	seed := withKeys(l.tx("seed", creator), testKey1, nil)
+	for entity, amount := range map[string]int{"user0@a": 100, "b": 0} {
+		value, err := sealAmount(seed, entity, amount)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.put(entity, value)
+	}
+	cc := new(SimpleChaincode)
+
+	tx := withKeys(l.tx("move", creator, "move", "user0@a", "b", "42"), testKey1, nil)
+	response := tx.invoke(cc)
+	if response.Status != 200 {
+		t.Fatalf("move: status %d %s", response.Status, response.Message)
+	}
+	if !strings.HasPrefix(string(tx.eventPayload), encryptedPrefix) || !strings.HasPrefix(string(response.Payload), encryptedPrefix) {
+		t.Fatalf("move sent in plain: event %q, response %q", tx.eventPayload, response.Payload)
+	}
+	event, err := openValue(tx, eventLabel+tx.event, tx.eventPayload)
+	if err != nil || !strings.Contains(string(event), `"value":42`) {
+		t.Errorf("event of move: %q, %v", event, err)
+	}
+	payload, err := openValue(tx, responseLabel, response.Payload)
+	if err != nil || !bytes.Equal(payload, event) {
+		t.Errorf("response of move: %q, %v", payload, err)
+	}
+	l.commit([]*mockTx{tx})
+
+	// read-only functions answer in plain to the holder of the key
+	query := withKeys(l.tx("query", creator, "query", "b"), testKey1, nil)
+	if balance := string(query.invoke(cc).Payload); balance != "42" {
+		t.Errorf("query: %q", balance)
+	}
+}
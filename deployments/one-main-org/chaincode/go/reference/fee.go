@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Fee schedules are json settings under fee:<function>:<asset>, or fee:<function> for any asset,
+// set with setConfig. The fee is taken off the gross amount the payer sends, the payee receives
+// the net amount and the fee collector, the "feeCollector" setting unless the schedule names its
+// own, the fee, all in the same transaction. A fee is a flat part plus basis points of the gross
+// amount, taken from the tier of the gross amount when the schedule has tiers, then kept between
+// the minimum and maximum of the schedule. Every function paying out token units charges its own
+// schedule: a batch per leg, a capture on the captured amount, a scheduled transfer when it is
+// made and a swap on its token legs.
+const feeConfigPrefix = "fee:"
+
+// feeFunctions are the functions that charge the fee schedule set for them
+var feeFunctions = map[string]bool{
+	"move":         true,
+	"transfer":     true,
+	"transferFrom": true,
+	"pay":          true,
+	"batchMove":    true,
+	"capture":      true,
+	"scheduleMove": true,
+	"acceptSwap":   true,
+}
+
+type feeTier struct {
+	From int `json:"from"` // smallest gross amount of the tier
+	Flat int `json:"flat,omitempty"`
+	Bps  int `json:"bps,omitempty"`
+}
+
+type feeSchedule struct {
+	Flat      int       `json:"flat,omitempty"`
+	Bps       int       `json:"bps,omitempty"` // basis points of the gross amount, 100 for 1%
+	Tiers     []feeTier `json:"tiers,omitempty"`
+	Min       int       `json:"min,omitempty"`
+	Max       int       `json:"max,omitempty"` // no maximum when 0
+	Collector string    `json:"collector,omitempty"`
+}
+
+func (s *feeSchedule) validate() error {
+	if s.Flat < 0 || s.Bps < 0 || s.Bps > 10000 || s.Min < 0 || s.Max < 0 {
+		return fmt.Errorf("flat, min and max must not be negative, bps between 0 and 10000")
+	}
+	if s.Max != 0 && s.Max < s.Min {
+		return fmt.Errorf("max must not be below min")
+	}
+	for i, tier := range s.Tiers {
+		if tier.Flat < 0 || tier.Bps < 0 || tier.Bps > 10000 {
+			return fmt.Errorf("flat of tier %d must not be negative, bps between 0 and 10000", i)
+		}
+		if i > 0 && tier.From <= s.Tiers[i-1].From {
+			return fmt.Errorf("tiers must be sorted by ascending from")
+		}
+	}
+	return nil
+}
+
+// fee charged on a gross amount
+func (s *feeSchedule) fee(gross int) int {
+	flat, bps := s.Flat, s.Bps
+	for _, tier := range s.Tiers {
+		if gross >= tier.From {
+			flat, bps = tier.Flat, tier.Bps
+		}
+	}
+	fee := flat + int(int64(gross)*int64(bps)/10000)
+	if fee < s.Min {
+		fee = s.Min
+	}
+	if s.Max != 0 && fee > s.Max {
+		fee = s.Max
+	}
+	return fee
+}
+
+func checkFeeSchedule(stub shim.ChaincodeStubInterface, name, value string) (string, error) {
+	function := strings.SplitN(strings.TrimPrefix(name, feeConfigPrefix), ":", 2)[0]
+	if !feeFunctions[function] {
+		return "", fmt.Errorf("function %s charges no fees", function)
+	}
+	s := &feeSchedule{}
+	if err := json.Unmarshal([]byte(value), s); err != nil {
+		return "", fmt.Errorf("invalid fee schedule: %s", err)
+	}
+	if err := s.validate(); err != nil {
+		return "", err
+	}
+	scheduleBytes, err := json.Marshal(s)
+	return string(scheduleBytes), err
+}
+
+// itemise splits a transfer of gross units of the token into the net amount and the fee the
+// schedule of the function charges
+func itemise(stub shim.ChaincodeStubInterface, function, from, to string, gross int) (*transferEvent, error) {
+	e := &transferEvent{From: from, To: to, Value: gross, Net: gross}
+
+	info, err := getTokenInfo(stub)
+	if err != nil {
+		return nil, err
+	}
+	s := &feeSchedule{}
+	found, err := configJSON(stub, feeConfigPrefix+function+":"+info.Symbol, s)
+	if err == nil && !found {
+		found, err = configJSON(stub, feeConfigPrefix+function, s)
+	}
+	if err != nil || !found {
+		return e, err
+	}
+
+	e.Fee = s.fee(gross)
+	e.Net = gross - e.Fee
+	if e.Collector = s.Collector; e.Collector == "" {
+		if e.Collector, err = configValue(stub, "feeCollector"); err != nil {
+			return nil, err
+		}
+	}
+	if e.Fee > 0 && e.Collector == "" {
+		return nil, fmt.Errorf("fee of %s charged without a collector, set feeCollector", function)
+	}
+	return e, nil
+}
+
+// applyTransfer debits the gross amount of a transfer, credits the net amount to the payee, creating
+// it when missing, and the fee to the collector, and sends the transfer as event
+func applyTransfer(stub shim.ChaincodeStubInterface, e *transferEvent) pb.Response {
+	if e.Net <= 0 {
+		return pb.Response{Status: 403, Message: fmt.Sprintf("Amount %d does not cover the fee of %d", e.Value, e.Fee)}
+	}
+
+	if response := spendVelocity(stub, map[string]int{e.From: e.Value}, nil); response.Status >= shim.ERRORTHRESHOLD {
+		return response
+	}
+
+	changes := map[string]int{}
+	changes[e.From] -= e.Value
+	changes[e.To] += e.Net
+	for entity := range changes {
+		found, err := entityExists(stub, entity)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if !found {
+			if err = writeAmount(stub, entity, 0); err != nil {
+				return shim.Error(err.Error())
+			}
+		}
+	}
+	if err := applyChanges(stub, changes); err != nil {
+		return errorResponse(err)
+	}
+	if err := creditFees(stub, map[string]int{e.Collector: e.Fee}); err != nil {
+		return errorResponse(err)
+	}
+
+	eventBytes, err := json.Marshal(e)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err = stub.SetEvent("Transfer", eventBytes); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(eventBytes)
+}
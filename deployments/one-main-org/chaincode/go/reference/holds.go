@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// A hold reserves part of a balance for a later capture, the available balance of an entity is its
+// balance minus its open holds that have not expired. Holds live under hold~entity~id, the id being
+// the transaction that placed the hold.
+const holdObjectType = "hold"
+
+const (
+	holdOpen     = "open"
+	holdCaptured = "captured"
+	holdReleased = "released"
+)
+
+type hold struct {
+	ID          string `json:"id"`
+	Entity      string `json:"entity"`
+	Amount      int    `json:"amount"`
+	Reason      string `json:"reason,omitempty"`
+	Expires     int64  `json:"expires,omitempty"`     // unix seconds, never when 0
+	Beneficiary string `json:"beneficiary,omitempty"` // identity allowed to capture to its accounts and release besides the owner
+	Status      string `json:"status"`
+	Captured    int    `json:"captured,omitempty"`
+	PlacedBy    string `json:"placedBy"`
+}
+
+func (h *hold) active(now int64) bool {
+	return h.Status == holdOpen && (h.Expires == 0 || now < h.Expires)
+}
+
+func getHold(stub shim.ChaincodeStubInterface, entity, holdID string) (*hold, error) {
+	h := &hold{}
+	found, err := getJSON(stub, holdObjectType, []string{entity, holdID}, h)
+	if err != nil || !found {
+		return nil, err
+	}
+	return h, nil
+}
+
+// activeHolds lists the open holds of an entity that have not expired
+func activeHolds(stub shim.ChaincodeStubInterface, entity string) ([]hold, error) {
+	now, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	it, err := stub.GetStateByPartialCompositeKey(holdObjectType, []string{entity})
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+
+	holds := []hold{}
+	for it.HasNext() {
+		kv, err := it.Next()
+		if err != nil {
+			return nil, err
+		}
+		var h hold
+		if err = openJSON(stub, kv.Key, kv.Value, &h); err != nil {
+			return nil, err
+		}
+		if h.active(now) {
+			holds = append(holds, h)
+		}
+	}
+
+	return holds, nil
+}
+
+// availableBalance is the balance of an entity minus its active holds, leaving out the hold with id except
+func availableBalance(stub shim.ChaincodeStubInterface, entity string, except string) (available int, found bool, err error) {
+	balance, found, err := getBalance(stub, entity)
+	if err != nil || !found {
+		return 0, found, err
+	}
+
+	holds, err := activeHolds(stub, entity)
+	if err != nil {
+		return 0, false, err
+	}
+	for _, h := range holds {
+		if h.ID != except {
+			balance -= h.Amount
+		}
+	}
+
+	return balance, true, nil
+}
+
+// holdParty checks the caller owns the entity of the hold or is its beneficiary
+func holdParty(stub shim.ChaincodeStubInterface, h *hold) (bool, error) {
+	id, err := getCreator(stub)
+	if err != nil {
+		return false, err
+	}
+	return id.owns(h.Entity) || (h.Beneficiary != "" && h.Beneficiary == id.name()), nil
+}
+
+// reserves an amount of an entity of the caller: entity, amount, reason, expiry and beneficiary, the last two may be empty
+func (t *SimpleChaincode) hold(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 5 {
+		return pb.Response{Status: 403, Message: "Incorrect number of arguments. Expecting entity, amount, reason, expiry and beneficiary"}
+	}
+
+	x, err := parseAmount(args[1])
+	if err != nil {
+		return pb.Response{Status: 403, Message: err.Error()}
+	}
+	expires, err := parseExpiry(args[3])
+	if err != nil {
+		return pb.Response{Status: 403, Message: err.Error()}
+	}
+
+	id, err := getCreator(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	h := &hold{ID: stub.GetTxID(), Entity: args[0], Amount: x, Reason: args[2], Expires: expires, Beneficiary: args[4], Status: holdOpen, PlacedBy: id.name()}
+	if !id.owns(h.Entity) {
+		return pb.Response{Status: 403, Message: "Only the owner of " + h.Entity + " may place holds on it"}
+	}
+
+	available, found, err := availableBalance(stub, h.Entity, "")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !found {
+		return pb.Response{Status: 404, Message: "Entity not found"}
+	}
+	if available < x {
+		return pb.Response{Status: 403, Message: fmt.Sprintf("Insufficient funds: %s has %d available", h.Entity, available)}
+	}
+
+	if err = putJSON(stub, holdObjectType, []string{h.Entity, h.ID}, h); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	holdBytes, err := json.Marshal(h)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err = stub.SetEvent("hold", holdBytes); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(holdBytes)
+}
+
+// pays all or part of a hold to an entity and releases the rest, a beneficiary not owning the entity of
+// the hold only to its own accounts: entity, hold id, recipient and amount, all of the hold when empty
+func (t *SimpleChaincode) capture(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 4 {
+		return pb.Response{Status: 403, Message: "Incorrect number of arguments. Expecting entity, hold id, recipient and amount"}
+	}
+
+	h, err := getHold(stub, args[0], args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if h == nil {
+		return pb.Response{Status: 404, Message: "Hold not found"}
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !h.active(now) {
+		return pb.Response{Status: 403, Message: "Hold is " + h.Status + " or expired"}
+	}
+	party, err := holdParty(stub, h)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !party {
+		return pb.Response{Status: 403, Message: "Only the owner of " + h.Entity + " or the beneficiary may capture the hold"}
+	}
+
+	to := args[2]
+	id, err := getCreator(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !id.owns(h.Entity) && !id.owns(to) {
+		return pb.Response{Status: 403, Message: "The beneficiary may only capture the hold to its own accounts"}
+	}
+	x := h.Amount
+	if args[3] != "" {
+		if x, err = parseAmount(args[3]); err != nil {
+			return pb.Response{Status: 403, Message: err.Error()}
+		}
+		if x > h.Amount {
+			return pb.Response{Status: 403, Message: "Capture exceeds the hold of " + strconv.Itoa(h.Amount)}
+		}
+	}
+
+	// the hold itself reserved the funds, the other holds still have to be honoured
+	available, _, err := availableBalance(stub, h.Entity, h.ID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if available < x {
+		return pb.Response{Status: 403, Message: fmt.Sprintf("Insufficient funds: %s has %d available", h.Entity, available)}
+	}
+
+	h.Status = holdCaptured
+	h.Captured = x
+	if err = putJSON(stub, holdObjectType, []string{h.Entity, h.ID}, h); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shiftUnits(stub, "capture", h.Entity, to, x)
+}
+
+// releases a hold without paying it: entity and hold id
+func (t *SimpleChaincode) release(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		return pb.Response{Status: 403, Message: "Incorrect number of arguments. Expecting entity and hold id"}
+	}
+
+	h, err := getHold(stub, args[0], args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if h == nil {
+		return pb.Response{Status: 404, Message: "Hold not found"}
+	}
+	if h.Status != holdOpen {
+		return pb.Response{Status: 403, Message: "Hold is " + h.Status}
+	}
+	party, err := holdParty(stub, h)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !party {
+		return pb.Response{Status: 403, Message: "Only the owner of " + h.Entity + " or the beneficiary may release the hold"}
+	}
+
+	h.Status = holdReleased
+	if err = putJSON(stub, holdObjectType, []string{h.Entity, h.ID}, h); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	holdBytes, err := json.Marshal(h)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err = stub.SetEvent("release", holdBytes); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(holdBytes)
+}
+
+// open holds of an entity with its balance and available balance
+func (t *SimpleChaincode) holds(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return pb.Response{Status: 403, Message: "Incorrect number of arguments. Expecting entity"}
+	}
+
+	balance, found, err := getBalance(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !found {
+		return pb.Response{Status: 404, Message: "Entity not found"}
+	}
+	holds, err := activeHolds(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	result := struct {
+		Balance   int    `json:"balance"`
+		Available int    `json:"available"`
+		Holds     []hold `json:"holds"`
+	}{Balance: balance, Available: balance, Holds: holds}
+	for _, h := range holds {
+		result.Available -= h.Amount
+	}
+
+	resultBytes, err := json.Marshal(result)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(resultBytes)
+}
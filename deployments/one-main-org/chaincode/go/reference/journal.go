@@ -0,0 +1,534 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// The journal is a double-entry ledger next to the entity balances: a chart of accounts under coa~code,
+// entries under journal~id, one posting per entry line under posting~account~period~date~id~line and
+// debit and credit totals per period under jtotal~period~account for the trial balance. Closing a
+// period closes every period before it as well, entries can only be posted after the latest closed
+// period, so closed periods and the opening balances carried out of them never change.
+const (
+	accountObjectType = "coa"
+	entryObjectType   = "journal"
+	postingObjectType = "posting"
+	totalObjectType   = "jtotal"
+	periodObjectType  = "period"
+)
+
+var accountTypes = map[string]bool{"asset": true, "liability": true, "equity": true, "income": true, "expense": true}
+
+// account of the chart of accounts
+type account struct {
+	Code string `json:"code"`
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// debitNormal accounts grow with debits, the others with credits
+func (a *account) debitNormal() bool {
+	return a.Type == "asset" || a.Type == "expense"
+}
+
+type journalLine struct {
+	Account string `json:"account"`
+	Debit   int    `json:"debit,omitempty"`
+	Credit  int    `json:"credit,omitempty"`
+	Memo    string `json:"memo,omitempty"`
+}
+
+type journalEntry struct {
+	ID          string        `json:"id"`
+	Date        string        `json:"date"` // YYYY-MM-DD, the period is its month
+	Period      string        `json:"period"`
+	Description string        `json:"description,omitempty"`
+	Lines       []journalLine `json:"lines"`
+	PostedBy    string        `json:"postedBy"`
+	TxID        string        `json:"txId"`
+}
+
+type posting struct {
+	EntryID     string `json:"entryId"`
+	Date        string `json:"date"`
+	Description string `json:"description,omitempty"`
+	Debit       int    `json:"debit,omitempty"`
+	Credit      int    `json:"credit,omitempty"`
+	Memo        string `json:"memo,omitempty"`
+	Balance     int    `json:"balance"` // running balance of the account, filled in by ledgerReport
+}
+
+type periodTotal struct {
+	Debit  int `json:"debit"`
+	Credit int `json:"credit"`
+}
+
+type periodClose struct {
+	Period   string `json:"period"`
+	ClosedBy string `json:"closedBy"`
+	TxID     string `json:"txId"`
+}
+
+func getAccount(stub shim.ChaincodeStubInterface, code string) (*account, error) {
+	a := &account{}
+	found, err := getJSON(stub, accountObjectType, []string{code}, a)
+	if err != nil || !found {
+		return nil, err
+	}
+	return a, nil
+}
+
+// latestClosedPeriod returns the last period closed, empty when none is
+func latestClosedPeriod(stub shim.ChaincodeStubInterface) (string, error) {
+	it, err := stub.GetStateByPartialCompositeKey(periodObjectType, []string{})
+	if err != nil {
+		return "", err
+	}
+	defer it.Close()
+
+	// YYYY-MM sorts chronologically, the last key is the latest period
+	latest := ""
+	for it.HasNext() {
+		kv, err := it.Next()
+		if err != nil {
+			return "", err
+		}
+		_, attributes, err := stub.SplitCompositeKey(kv.Key)
+		if err != nil {
+			return "", err
+		}
+		latest = attributes[0]
+	}
+	return latest, nil
+}
+
+// periodClosed tells whether a period is the latest closed period or before it
+func periodClosed(stub shim.ChaincodeStubInterface, period string) (bool, error) {
+	latest, err := latestClosedPeriod(stub)
+	if err != nil {
+		return false, err
+	}
+	return period <= latest, nil
+}
+
+func validPeriod(period string) bool {
+	_, err := time.Parse("2006-01", period)
+	return err == nil
+}
+
+// adds an account to the chart of accounts: code, name, type
+func (t *SimpleChaincode) addAccount(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return pb.Response{Status: 403, Message: "Incorrect number of arguments. Expecting code, name and type"}
+	}
+
+	a := &account{Code: args[0], Name: args[1], Type: args[2]}
+	if a.Code == "" {
+		return pb.Response{Status: 403, Message: "Empty account code"}
+	}
+	if !accountTypes[a.Type] {
+		return pb.Response{Status: 403, Message: "Invalid account type, expecting asset, liability, equity, income or expense"}
+	}
+
+	existing, err := getAccount(stub, a.Code)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if existing != nil {
+		return pb.Response{Status: 409, Message: "Account " + a.Code + " already exists"}
+	}
+
+	err = putJSON(stub, accountObjectType, []string{a.Code}, a)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// lists the chart of accounts
+func (t *SimpleChaincode) chartOfAccounts(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	it, err := stub.GetStateByPartialCompositeKey(accountObjectType, []string{})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer it.Close()
+
+	accounts := []account{}
+	for it.HasNext() {
+		kv, err := it.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		var a account
+		if err = json.Unmarshal(kv.Value, &a); err != nil {
+			return shim.Error(err.Error())
+		}
+		accounts = append(accounts, a)
+	}
+
+	accountsBytes, err := json.Marshal(accounts)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(accountsBytes)
+}
+
+// validateEntry checks the lines of an entry reference known accounts and balance
+func validateEntry(stub shim.ChaincodeStubInterface, e *journalEntry) error {
+	if len(e.Lines) < 2 {
+		return fmt.Errorf("an entry needs at least two lines")
+	}
+
+	var debits, credits int
+	for i, l := range e.Lines {
+		if (l.Debit > 0) == (l.Credit > 0) || l.Debit < 0 || l.Credit < 0 {
+			return fmt.Errorf("line %d: expecting either a positive debit or a positive credit", i)
+		}
+		a, err := getAccount(stub, l.Account)
+		if err != nil {
+			return err
+		}
+		if a == nil {
+			return fmt.Errorf("line %d: account %s not found", i, l.Account)
+		}
+		debits += l.Debit
+		credits += l.Credit
+	}
+	if debits != credits {
+		return fmt.Errorf("entry does not balance: debits %d, credits %d", debits, credits)
+	}
+
+	return nil
+}
+
+// posts a balanced journal entry given as json, the entry id defaults to the transaction id
+// and its date to the transaction date
+func (t *SimpleChaincode) postJournal(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return pb.Response{Status: 403, Message: "Incorrect number of arguments. Expecting entry as json"}
+	}
+
+	e := &journalEntry{}
+	if err := json.Unmarshal([]byte(args[0]), e); err != nil {
+		return pb.Response{Status: 403, Message: "Invalid entry: " + err.Error()}
+	}
+
+	id, err := getCreator(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	e.PostedBy = id.name()
+	e.TxID = stub.GetTxID()
+	if e.ID == "" {
+		e.ID = e.TxID
+	}
+	if e.Date == "" {
+		ts, err := stub.GetTxTimestamp()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		e.Date = time.Unix(ts.Seconds, 0).UTC().Format("2006-01-02")
+	}
+	date, err := time.Parse("2006-01-02", e.Date)
+	if err != nil {
+		return pb.Response{Status: 403, Message: "Invalid date, expecting YYYY-MM-DD"}
+	}
+	e.Period = date.Format("2006-01")
+
+	if err = validateEntry(stub, e); err != nil {
+		return pb.Response{Status: 403, Message: "Invalid entry: " + err.Error()}
+	}
+
+	closed, err := periodClosed(stub, e.Period)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if closed {
+		return pb.Response{Status: 403, Message: "Period " + e.Period + " is closed"}
+	}
+
+	exists, err := getJSON(stub, entryObjectType, []string{e.ID}, &journalEntry{})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if exists {
+		return pb.Response{Status: 409, Message: "Entry " + e.ID + " already posted"}
+	}
+
+	err = putJSON(stub, entryObjectType, []string{e.ID}, e)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// one total update per account even when it appears on several lines
+	totals := map[string]*periodTotal{}
+	for i, l := range e.Lines {
+		p := posting{EntryID: e.ID, Date: e.Date, Description: e.Description, Debit: l.Debit, Credit: l.Credit, Memo: l.Memo}
+		err = putJSON(stub, postingObjectType, []string{l.Account, e.Period, e.Date, e.ID, strconv.Itoa(i)}, p)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		total := totals[l.Account]
+		if total == nil {
+			total = &periodTotal{}
+			if _, err = getJSON(stub, totalObjectType, []string{e.Period, l.Account}, total); err != nil {
+				return shim.Error(err.Error())
+			}
+			totals[l.Account] = total
+		}
+		total.Debit += l.Debit
+		total.Credit += l.Credit
+	}
+	for code, total := range totals {
+		if err = putJSON(stub, totalObjectType, []string{e.Period, code}, total); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	entryBytes, err := json.Marshal(e)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.SetEvent("postJournal", entryBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(entryBytes)
+}
+
+// closes a period YYYY-MM and the periods before it, no entries can be posted to them afterwards.
+// Periods after the month of the transaction cannot be closed yet.
+func (t *SimpleChaincode) closePeriod(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 || !validPeriod(args[0]) {
+		return pb.Response{Status: 403, Message: "Incorrect arguments. Expecting period as YYYY-MM"}
+	}
+	period := args[0]
+
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if current := time.Unix(now, 0).UTC().Format("2006-01"); period > current {
+		return pb.Response{Status: 403, Message: "Period " + period + " has not started, the current period is " + current}
+	}
+
+	latest, err := latestClosedPeriod(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if period <= latest {
+		return pb.Response{Status: 409, Message: "Period " + period + " is already closed, periods up to " + latest + " are"}
+	}
+
+	id, err := getCreator(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = putJSON(stub, periodObjectType, []string{period}, periodClose{Period: period, ClosedBy: id.name(), TxID: stub.GetTxID()})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+type trialBalanceLine struct {
+	account
+	Debit   int `json:"debit"`
+	Credit  int `json:"credit"`
+	Balance int `json:"balance"` // on the normal side of the account
+}
+
+type trialBalance struct {
+	Period   string             `json:"period,omitempty"`
+	Accounts []trialBalanceLine `json:"accounts"`
+	Debit    int                `json:"debit"`
+	Credit   int                `json:"credit"`
+}
+
+// trial balance of all accounts up to and including a period YYYY-MM, of all periods without argument
+func (t *SimpleChaincode) trialBalance(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var period string
+	if len(args) > 0 {
+		if !validPeriod(args[0]) {
+			return pb.Response{Status: 403, Message: "Invalid period, expecting YYYY-MM"}
+		}
+		period = args[0]
+	}
+
+	it, err := stub.GetStateByPartialCompositeKey(totalObjectType, []string{})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer it.Close()
+
+	sums := map[string]*trialBalanceLine{}
+	for it.HasNext() {
+		kv, err := it.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		_, attributes, err := stub.SplitCompositeKey(kv.Key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if period != "" && attributes[0] > period {
+			continue
+		}
+		var total periodTotal
+		if err = openJSON(stub, kv.Key, kv.Value, &total); err != nil {
+			return shim.Error(err.Error())
+		}
+		line := sums[attributes[1]]
+		if line == nil {
+			line = &trialBalanceLine{}
+			sums[attributes[1]] = line
+		}
+		line.Debit += total.Debit
+		line.Credit += total.Credit
+	}
+
+	codes := make([]string, 0, len(sums))
+	for code := range sums {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+
+	tb := trialBalance{Period: period, Accounts: []trialBalanceLine{}}
+	for _, code := range codes {
+		a, err := getAccount(stub, code)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		line := sums[code]
+		line.account = *a
+		if a.debitNormal() {
+			line.Balance = line.Debit - line.Credit
+		} else {
+			line.Balance = line.Credit - line.Debit
+		}
+		tb.Accounts = append(tb.Accounts, *line)
+		tb.Debit += line.Debit
+		tb.Credit += line.Credit
+	}
+
+	tbBytes, err := json.Marshal(tb)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(tbBytes)
+}
+
+// openingBalance is the balance of an account carried into a period from the periods before it
+func openingBalance(stub shim.ChaincodeStubInterface, a *account, period string) (int, error) {
+	it, err := stub.GetStateByPartialCompositeKey(totalObjectType, []string{})
+	if err != nil {
+		return 0, err
+	}
+	defer it.Close()
+
+	balance := 0
+	for it.HasNext() {
+		kv, err := it.Next()
+		if err != nil {
+			return 0, err
+		}
+		_, attributes, err := stub.SplitCompositeKey(kv.Key)
+		if err != nil {
+			return 0, err
+		}
+		if attributes[0] >= period || attributes[1] != a.Code {
+			continue
+		}
+		var total periodTotal
+		if err = openJSON(stub, kv.Key, kv.Value, &total); err != nil {
+			return 0, err
+		}
+		if a.debitNormal() {
+			balance += total.Debit - total.Credit
+		} else {
+			balance += total.Credit - total.Debit
+		}
+	}
+	return balance, nil
+}
+
+// postings of an account with their running balance, optionally of a single period YYYY-MM whose
+// running balance starts at the balance carried from the periods before
+func (t *SimpleChaincode) ledgerReport(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 1 || len(args) > 2 {
+		return pb.Response{Status: 403, Message: "Incorrect number of arguments. Expecting account and optional period"}
+	}
+
+	a, err := getAccount(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if a == nil {
+		return pb.Response{Status: 404, Message: "Account not found"}
+	}
+
+	attributes := []string{a.Code}
+	if len(args) == 2 {
+		if !validPeriod(args[1]) {
+			return pb.Response{Status: 403, Message: "Invalid period, expecting YYYY-MM"}
+		}
+		attributes = append(attributes, args[1])
+	}
+
+	it, err := stub.GetStateByPartialCompositeKey(postingObjectType, attributes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer it.Close()
+
+	report := struct {
+		Account  *account  `json:"account"`
+		Opening  int       `json:"opening"`
+		Postings []posting `json:"postings"`
+		Balance  int       `json:"balance"`
+	}{Account: a, Postings: []posting{}}
+	if len(args) == 2 {
+		if report.Opening, err = openingBalance(stub, a, args[1]); err != nil {
+			return shim.Error(err.Error())
+		}
+		report.Balance = report.Opening
+	}
+
+	for it.HasNext() {
+		kv, err := it.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		var p posting
+		if err = openJSON(stub, kv.Key, kv.Value, &p); err != nil {
+			return shim.Error(err.Error())
+		}
+		if a.debitNormal() {
+			report.Balance += p.Debit - p.Credit
+		} else {
+			report.Balance += p.Credit - p.Debit
+		}
+		p.Balance = report.Balance
+		report.Postings = append(report.Postings, p)
+	}
+
+	reportBytes, err := json.Marshal(report)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(reportBytes)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// In delta mode a change to a balance is written as its own key delta~entity~txID instead of
+// rewriting the balance key, so concurrent transactions crediting or debiting the same entity
+// do not collide at MVCC validation. Balances are the balance key plus all pending deltas,
+// compact folds the deltas back into the balance key. Credits never read the balance, debits
+// still read the balance of the payer to check its funds. Fees are credited to their collector as
+// deltas in either mode, every transfer charging a fee would otherwise rewrite the same balance.
+const deltaObjectType = "delta"
+
+func deltaMode(stub shim.ChaincodeStubInterface) (bool, error) {
+	return configBool(stub, "deltaMode")
+}
+
+// entityExists tells whether the entity has a balance key, without reading its deltas
+func entityExists(stub shim.ChaincodeStubInterface, entity string) (bool, error) {
+	valBytes, err := stub.GetState(entity)
+	if err != nil {
+		return false, err
+	}
+	return valBytes != nil, nil
+}
+
+// getBalance returns the balance of an entity including its pending deltas, found is false when the entity does not exist
+func getBalance(stub shim.ChaincodeStubInterface, entity string) (balance int, found bool, err error) {
+	balance, found, err = readAmount(stub, entity)
+	if err != nil || !found {
+		return 0, false, err
+	}
+
+	deltas, _, err := getDeltas(stub, entity)
+	if err != nil {
+		return 0, false, err
+	}
+
+	return balance + deltas, true, nil
+}
+
+// getDeltas sums the pending deltas of an entity and returns their keys
+func getDeltas(stub shim.ChaincodeStubInterface, entity string) (sum int, keys []string, err error) {
+	it, err := stub.GetStateByPartialCompositeKey(deltaObjectType, []string{entity})
+	if err != nil {
+		return 0, nil, err
+	}
+	defer it.Close()
+
+	for it.HasNext() {
+		kv, err := it.Next()
+		if err != nil {
+			return 0, nil, err
+		}
+		delta, err := openAmount(stub, kv.Key, kv.Value)
+		if err != nil {
+			return 0, nil, err
+		}
+		sum += delta
+		keys = append(keys, kv.Key)
+	}
+
+	return sum, keys, nil
+}
+
+// applyChanges credits positive and debits negative amounts to entities: one balance write
+// per entity, or in delta mode one delta key per entity and no balance read at all. It fails
+// with a statusError when one of the entities is not active.
+func applyChanges(stub shim.ChaincodeStubInterface, changes map[string]int) error {
+	deltas, err := deltaMode(stub)
+	if err != nil {
+		return err
+	}
+
+	for entity, amount := range changes {
+		if amount == 0 {
+			continue
+		}
+		if err = checkActive(stub, entity); err != nil {
+			return err
+		}
+
+		if deltas {
+			key, err := stub.CreateCompositeKey(deltaObjectType, []string{entity, stub.GetTxID()})
+			if err != nil {
+				return err
+			}
+			err = writeAmount(stub, key, amount)
+			if err != nil {
+				return err
+			}
+			txLog(stub).Debugf("%s delta %d", entity, amount)
+			continue
+		}
+
+		// the balance key alone, pending deltas stay pending
+		balance, _, err := readAmount(stub, entity)
+		if err != nil {
+			return err
+		}
+		err = writeAmount(stub, entity, balance+amount)
+		if err != nil {
+			return err
+		}
+		txLog(stub).Debugf("%s = %d", entity, balance+amount)
+	}
+
+	return nil
+}
+
+// creditFees credits the fees of a transaction to their collectors, creating them when missing.
+// The fees go to delta~collector~txID~fee keys whatever the mode, so the collector balance is
+// never read and concurrent transfers charging fees do not conflict at MVCC validation.
+func creditFees(stub shim.ChaincodeStubInterface, fees map[string]int) error {
+	for collector, fee := range fees {
+		if fee == 0 {
+			continue
+		}
+		if err := checkActive(stub, collector); err != nil {
+			return err
+		}
+		found, err := entityExists(stub, collector)
+		if err != nil {
+			return err
+		}
+		if !found {
+			if err = writeAmount(stub, collector, 0); err != nil {
+				return err
+			}
+		}
+
+		key, err := stub.CreateCompositeKey(deltaObjectType, []string{collector, stub.GetTxID(), "fee"})
+		if err != nil {
+			return err
+		}
+		if err = writeAmount(stub, key, fee); err != nil {
+			return err
+		}
+		txLog(stub).Debugf("%s fee %d", collector, fee)
+	}
+
+	return nil
+}
+
+// compactEntity folds the pending deltas of an entity into its balance key
+func compactEntity(stub shim.ChaincodeStubInterface, entity string) (int, error) {
+	balance, found, err := getBalance(stub, entity)
+	if err != nil || !found {
+		return 0, err
+	}
+
+	_, keys, err := getDeltas(stub, entity)
+	if err != nil {
+		return 0, err
+	}
+	if len(keys) == 0 {
+		return 0, nil
+	}
+
+	for _, key := range keys {
+		if err = stub.DelState(key); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(keys), writeAmount(stub, entity, balance)
+}
+
+// getJSON reads the json value of a composite key into v, found is false when the key does not exist
+func getJSON(stub shim.ChaincodeStubInterface, objectType string, attributes []string, v interface{}) (found bool, err error) {
+	key, err := stub.CreateCompositeKey(objectType, attributes)
+	if err != nil {
+		return false, err
+	}
+	valueBytes, err := stub.GetState(key)
+	if err != nil || valueBytes == nil {
+		return false, err
+	}
+	return true, openJSON(stub, key, valueBytes, v)
+}
+
+// openJSON reads the json value of a state key into v, sealed or not
+func openJSON(stub shim.ChaincodeStubInterface, key string, value []byte, v interface{}) error {
+	plain, err := openValue(stub, key, value)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(plain, v)
+}
+
+// putJSON writes v as the json value of a composite key, sealed for the types holding amounts
+func putJSON(stub shim.ChaincodeStubInterface, objectType string, attributes []string, v interface{}) error {
+	key, err := stub.CreateCompositeKey(objectType, attributes)
+	if err != nil {
+		return err
+	}
+	valueBytes, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if sealedObjectTypes[objectType] {
+		if valueBytes, err = sealValue(stub, key, valueBytes); err != nil {
+			return err
+		}
+	}
+	return stub.PutState(key, valueBytes)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+const (
+	hotAccount = "merchant@b"
+	payers     = 50
+	blockSize  = 10 // moves endorsed against the same state and committed together
+)
+
+// hotAccountLedger has payers user<i>@a with funds and a merchant all of them pay into
+func hotAccountLedger(b *testing.B, deltas bool) (*mockLedger, [][]byte) {
+	l := newMockLedger()
+	balances := map[string]int{hotAccount: 0}
+	creators := make([][]byte, payers)
+	for i := range creators {
+		cn := "user" + strconv.Itoa(i)
+		balances[cn+"@a"] = 1 << 30
+		creators[i] = testCreator(b, cn, "a")
+	}
+	l.seedBalances(balances)
+	if deltas {
+		l.setConfig("deltaMode", "true")
+	}
+	return l, creators
+}
+
+// benchmarkHotAccount endorses blocks of concurrent moves into one account and reports how many
+// of them MVCC validation rejects for reading a key another move of the block wrote
+func benchmarkHotAccount(b *testing.B, deltas bool) {
+	l, creators := hotAccountLedger(b, deltas)
+	cc := new(SimpleChaincode)
+
+	endorsed, conflicts := 0, 0
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		block := make([]*mockTx, blockSize)
+		var wg sync.WaitGroup
+		for i := range block {
+			payer := (n*blockSize + i) % payers
+			txID := fmt.Sprintf("tx%d-%d", n, i)
+			block[i] = l.tx(txID, creators[payer], "move", "user"+strconv.Itoa(payer)+"@a", hotAccount, "1")
+			wg.Add(1)
+			go func(tx *mockTx) {
+				defer wg.Done()
+				tx.invoke(cc)
+			}(block[i])
+		}
+		wg.Wait()
+
+		for _, tx := range block {
+			if tx.response.Status >= 400 {
+				b.Fatalf("move failed with status %d: %s", tx.response.Status, tx.response.Message)
+			}
+		}
+		endorsed += len(block)
+		conflicts += l.commit(block)
+	}
+	b.StopTimer()
+
+	b.ReportMetric(float64(conflicts)/float64(endorsed), "conflicts/tx")
+	if !deltas && b.N > 0 && conflicts == 0 {
+		b.Error("moves rewriting the balance of the hot account did not conflict")
+	}
+	if deltas && conflicts != 0 {
+		b.Errorf("%d of %d moves in delta mode conflicted", conflicts, endorsed)
+	}
+}
+
+func BenchmarkHotAccount(b *testing.B) {
+	b.Run("normal", func(b *testing.B) { benchmarkHotAccount(b, false) })
+	b.Run("delta", func(b *testing.B) { benchmarkHotAccount(b, true) })
+}
+
+// TestDeltaModeCompaction checks that balances keep the pending deltas and compact folds them in
+func TestDeltaModeCompaction(t *testing.T) {
+	l := newMockLedger()
+	creator := testCreator(t, "user0", "a")
+	l.seedBalances(map[string]int{"user0@a": 100, hotAccount: 5})
+	l.setConfig("deltaMode", "true")
+	cc := new(SimpleChaincode)
+
+	for i := 0; i < 3; i++ {
+		tx := l.tx("move"+strconv.Itoa(i), creator, "move", "user0@a", hotAccount, "10")
+		tx.invoke(cc)
+		if conflicts := l.commit([]*mockTx{tx}); tx.response.Status != 200 || conflicts != 0 {
+			t.Fatalf("move: status %d %s, %d conflicts", tx.response.Status, tx.response.Message, conflicts)
+		}
+	}
+	if string(l.state[hotAccount].value) != "5" {
+		t.Errorf("balance key of %s rewritten in delta mode: %s", hotAccount, l.state[hotAccount].value)
+	}
+
+	query := func(entity string) string {
+		tx := l.tx("query", creator, "query", entity)
+		return string(tx.invoke(cc).Payload)
+	}
+	if balance := query(hotAccount); balance != "35" {
+		t.Errorf("balance of %s with deltas: %s, expected 35", hotAccount, balance)
+	}
+
+	tx := l.tx("compact", creator, "compact", hotAccount, "user0@a")
+	tx.invoke(cc)
+	l.commit([]*mockTx{tx})
+	if tx.response.Status != 200 || string(tx.response.Payload) != `{"merchant@b":3,"user0@a":3}` {
+		t.Fatalf("compact: status %d %s %s", tx.response.Status, tx.response.Message, tx.response.Payload)
+	}
+	if string(l.state[hotAccount].value) != "35" || query(hotAccount) != "35" || query("user0@a") != "70" {
+		t.Errorf("balances after compaction: %s %s, %s", l.state[hotAccount].value, query(hotAccount), query("user0@a"))
+	}
+}
+
+// TestFeesDoNotConflict checks that moves between different entities do not conflict over the fee
+// collector they all credit, delta mode or not
+func TestFeesDoNotConflict(t *testing.T) {
+	l := newMockLedger()
+	balances := map[string]int{"fees": 0}
+	creators := make([][]byte, blockSize)
+	for i := range creators {
+		cn := "user" + strconv.Itoa(i)
+		balances[cn+"@a"] = 100
+		balances["payee"+strconv.Itoa(i)] = 0
+		creators[i] = testCreator(t, cn, "a")
+	}
+	l.seedBalances(balances)
+	l.setConfig("feeCollector", "fees")
+	l.setConfig(feeConfigPrefix+"move", `{"flat":1}`)
+	cc := new(SimpleChaincode)
+
+	block := make([]*mockTx, blockSize)
+	for i := range block {
+		block[i] = l.tx("tx"+strconv.Itoa(i), creators[i], "move", "user"+strconv.Itoa(i)+"@a", "payee"+strconv.Itoa(i), "10")
+		if response := block[i].invoke(cc); response.Status != 200 {
+			t.Fatalf("move: status %d %s", response.Status, response.Message)
+		}
+	}
+	if conflicts := l.commit(block); conflicts != 0 {
+		t.Errorf("%d of %d moves conflicted over the fee collector", conflicts, len(block))
+	}
+
+	query := l.tx("query", creators[0], "query", "fees")
+	if balance := string(query.invoke(cc).Payload); balance != strconv.Itoa(blockSize) {
+		t.Errorf("fees collected: %s, expected %d", balance, blockSize)
+	}
+	if string(l.state["fees"].value) != "0" {
+		t.Errorf("balance key of the fee collector rewritten: %s", l.state["fees"].value)
+	}
+}
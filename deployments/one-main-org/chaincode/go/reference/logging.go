@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+
+	"observability"
+)
+
+func checkLogConfig(stub shim.ChaincodeStubInterface, name, value string) (string, error) {
+	c := &observability.LogConfig{}
+	if err := json.Unmarshal([]byte(value), c); err != nil {
+		return "", fmt.Errorf("invalid logging config: %s", err)
+	}
+	if err := c.Validate(); err != nil {
+		return "", err
+	}
+	configBytes, err := json.Marshal(c)
+	return string(configBytes), err
+}
+
+// loadLogConfig reads the logging settings of the ledger, falling back to CORE_CHAINCODE_LOGGING_LEVEL for the level
+func loadLogConfig(stub shim.ChaincodeStubInterface) *observability.LogConfig {
+	c := &observability.LogConfig{}
+	value, err := getConfig(stub, "logging")
+	if err != nil {
+		logger.Warning("cannot read logging config: " + err.Error())
+	} else if value != nil {
+		if err = json.Unmarshal(value, c); err != nil {
+			logger.Warning("cannot parse logging config: " + err.Error())
+		}
+	}
+	if c.Level == "" {
+		c.Level = os.Getenv("CORE_CHAINCODE_LOGGING_LEVEL")
+	}
+	return c
+}
+
+func newTxLogger(stub shim.ChaincodeStubInterface, function string) *observability.TxLogger {
+	return observability.NewTxLogger(logger, stub, function, loadLogConfig(stub))
+}
+
+// txLog returns the logger of the transaction the stub was handed to
+func txLog(stub shim.ChaincodeStubInterface) *observability.TxLogger {
+	if ts, ok := stub.(*txStub); ok {
+		return ts.log
+	}
+	return newTxLogger(stub, "")
+}
+
+// txStub is the stub handed to chaincode functions, it carries the transaction logger and the
+// settings read so far along
+type txStub struct {
+	shim.ChaincodeStubInterface
+	log    *observability.TxLogger
+	config map[string][]byte
+}
@@ -0,0 +1,18 @@
+package main
+
+import "observability"
+
+var metrics = observability.NewRegistry()
+
+// GetState counts state reads and their payload size
+func (s *txStub) GetState(key string) ([]byte, error) {
+	value, err := s.ChaincodeStubInterface.GetState(key)
+	metrics.ObserveRead(s.log.Function, len(value))
+	return value, err
+}
+
+// PutState counts state writes and their payload size
+func (s *txStub) PutState(key string, value []byte) error {
+	metrics.ObserveWrite(s.log.Function, len(value))
+	return s.ChaincodeStubInterface.PutState(key, value)
+}
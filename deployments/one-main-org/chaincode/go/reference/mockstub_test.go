@@ -0,0 +1,329 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/ledger/queryresult"
+	"github.com/hyperledger/fabric/protos/msp"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// mockLedger is the committed state of a peer: every key carries the number of the transaction
+// that last wrote it, the version MVCC validation compares read sets against.
+type mockLedger struct {
+	state  map[string]versionedValue
+	height int // committed transactions
+	time   int64
+}
+
+type versionedValue struct {
+	value   []byte
+	version int
+}
+
+func newMockLedger() *mockLedger {
+	return &mockLedger{state: map[string]versionedValue{}, time: 1700000000}
+}
+
+// put writes a value directly, as if a transaction had committed it
+func (l *mockLedger) put(key string, value []byte) {
+	l.height++
+	l.state[key] = versionedValue{value, l.height}
+}
+
+// rangeKeys returns the committed keys in [start, end) with their versions
+func (l *mockLedger) rangeKeys(start, end string) map[string]int {
+	keys := map[string]int{}
+	for key, v := range l.state {
+		if key >= start && key < end {
+			keys[key] = v.version
+		}
+	}
+	return keys
+}
+
+// tx starts the simulation of a transaction of the creator against the committed state
+func (l *mockLedger) tx(txID string, creator []byte, args ...string) *mockTx {
+	tx := &mockTx{
+		ledger:  l,
+		txID:    txID,
+		creator: creator,
+		reads:   map[string]int{},
+		writes:  map[string][]byte{},
+	}
+	for _, arg := range args {
+		tx.args = append(tx.args, []byte(arg))
+	}
+	return tx
+}
+
+// commit validates transactions endorsed against the same state in block order, the way the peer
+// does: a transaction whose reads changed since its simulation is marked invalid and its writes
+// are dropped. It returns the number of invalid transactions.
+func (l *mockLedger) commit(txs []*mockTx) int {
+	conflicts := 0
+	for _, tx := range txs {
+		if tx.response.Status >= shim.ERRORTHRESHOLD {
+			continue
+		}
+		if !tx.valid() {
+			conflicts++
+			continue
+		}
+		l.height++
+		keys := make([]string, 0, len(tx.writes))
+		for key := range tx.writes {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if tx.writes[key] == nil {
+				delete(l.state, key)
+			} else {
+				l.state[key] = versionedValue{tx.writes[key], l.height}
+			}
+		}
+	}
+	return conflicts
+}
+
+type rangeRead struct {
+	start, end string
+	keys       map[string]int
+}
+
+// mockTx is the stub of one simulated transaction. Like on a peer, reads see the committed state
+// only, never the writes of the transaction itself. Unused stub methods are left unimplemented.
+type mockTx struct {
+	shim.ChaincodeStubInterface
+
+	ledger    *mockLedger
+	txID      string
+	args      [][]byte
+	creator   []byte
+	transient map[string][]byte
+
+	reads  map[string]int // version read per key, 0 when missing
+	ranges []rangeRead
+	writes map[string][]byte // nil for deletes
+
+	response     pb.Response
+	event        string
+	eventPayload []byte
+}
+
+// invoke simulates the transaction through the Invoke of the chaincode
+func (s *mockTx) invoke(cc shim.Chaincode) pb.Response {
+	s.response = cc.Invoke(s)
+	return s.response
+}
+
+func (s *mockTx) valid() bool {
+	for key, version := range s.reads {
+		if s.ledger.state[key].version != version {
+			return false
+		}
+	}
+	// phantom reads: a range query must return the same keys at the same versions
+	for _, r := range s.ranges {
+		keys := s.ledger.rangeKeys(r.start, r.end)
+		if len(keys) != len(r.keys) {
+			return false
+		}
+		for key, version := range r.keys {
+			if keys[key] != version {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (s *mockTx) GetArgs() [][]byte {
+	return s.args
+}
+
+func (s *mockTx) GetStringArgs() []string {
+	args := make([]string, len(s.args))
+	for i, arg := range s.args {
+		args[i] = string(arg)
+	}
+	return args
+}
+
+func (s *mockTx) GetFunctionAndParameters() (string, []string) {
+	args := s.GetStringArgs()
+	if len(args) == 0 {
+		return "", nil
+	}
+	return args[0], args[1:]
+}
+
+func (s *mockTx) GetTxID() string {
+	return s.txID
+}
+
+func (s *mockTx) GetChannelID() string {
+	return "common"
+}
+
+func (s *mockTx) GetCreator() ([]byte, error) {
+	return s.creator, nil
+}
+
+func (s *mockTx) GetTransient() (map[string][]byte, error) {
+	return s.transient, nil
+}
+
+func (s *mockTx) GetTxTimestamp() (*timestamp.Timestamp, error) {
+	return &timestamp.Timestamp{Seconds: s.ledger.time}, nil
+}
+
+func (s *mockTx) GetState(key string) ([]byte, error) {
+	v := s.ledger.state[key]
+	s.reads[key] = v.version
+	return v.value, nil
+}
+
+func (s *mockTx) PutState(key string, value []byte) error {
+	if key == "" {
+		return errors.New("empty key")
+	}
+	if value == nil {
+		value = []byte{}
+	}
+	s.writes[key] = value
+	return nil
+}
+
+func (s *mockTx) DelState(key string) error {
+	s.writes[key] = nil
+	return nil
+}
+
+type mockIterator struct {
+	kvs []*queryresult.KV
+}
+
+func (it *mockIterator) HasNext() bool {
+	return len(it.kvs) > 0
+}
+
+func (it *mockIterator) Next() (*queryresult.KV, error) {
+	kv := it.kvs[0]
+	it.kvs = it.kvs[1:]
+	return kv, nil
+}
+
+func (it *mockIterator) Close() error {
+	return nil
+}
+
+func (s *mockTx) queryRange(start, end string) shim.StateQueryIteratorInterface {
+	keys := s.ledger.rangeKeys(start, end)
+	s.ranges = append(s.ranges, rangeRead{start, end, keys})
+
+	sorted := make([]string, 0, len(keys))
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+	it := &mockIterator{}
+	for _, key := range sorted {
+		it.kvs = append(it.kvs, &queryresult.KV{Key: key, Value: s.ledger.state[key].value})
+	}
+	return it
+}
+
+// GetStateByRange covers the simple keys only, like the peer it skips composite keys
+func (s *mockTx) GetStateByRange(startKey, endKey string) (shim.StateQueryIteratorInterface, error) {
+	if startKey == "" {
+		startKey = "\x01"
+	}
+	if endKey == "" {
+		endKey = string(rune(0x10FFFF))
+	}
+	return s.queryRange(startKey, endKey), nil
+}
+
+func (s *mockTx) GetStateByPartialCompositeKey(objectType string, attributes []string) (shim.StateQueryIteratorInterface, error) {
+	prefix, err := s.CreateCompositeKey(objectType, attributes)
+	if err != nil {
+		return nil, err
+	}
+	return s.queryRange(prefix, prefix+string(rune(0x10FFFF))), nil
+}
+
+func (s *mockTx) CreateCompositeKey(objectType string, attributes []string) (string, error) {
+	key := "\x00" + objectType + "\x00"
+	for _, attribute := range attributes {
+		key += attribute + "\x00"
+	}
+	return key, nil
+}
+
+func (s *mockTx) SplitCompositeKey(compositeKey string) (string, []string, error) {
+	parts := strings.Split(strings.TrimPrefix(compositeKey, "\x00"), "\x00")
+	return parts[0], parts[1 : len(parts)-1], nil
+}
+
+func (s *mockTx) SetEvent(name string, payload []byte) error {
+	s.event, s.eventPayload = name, payload
+	return nil
+}
+
+// testCreator returns the serialized identity of CN cn issued by org, with the given OUs as roles
+func testCreator(tb testing.TB, cn, org string, ous ...string) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn, OrganizationalUnit: ous},
+		NotBefore:    time.Unix(1600000000, 0),
+		NotAfter:     time.Unix(1900000000, 0),
+	}
+	issuer := &x509.Certificate{SerialNumber: big.NewInt(2), Subject: pkix.Name{Organization: []string{org + ".example.com"}}}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, &key.PublicKey, key)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	creatorBytes, err := proto.Marshal(&msp.SerializedIdentity{
+		Mspid:   strings.Title(org) + "MSP",
+		IdBytes: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return creatorBytes
+}
+
+// seedBalances writes plain balances of the entities straight into the ledger
+func (l *mockLedger) seedBalances(balances map[string]int) {
+	for entity, balance := range balances {
+		l.put(entity, []byte(strconv.Itoa(balance)))
+	}
+}
+
+// setConfig writes a setting straight into the ledger
+func (l *mockLedger) setConfig(name, value string) {
+	key, _ := (&mockTx{}).CreateCompositeKey(configObjectType, []string{name})
+	l.put(key, []byte(value))
+}
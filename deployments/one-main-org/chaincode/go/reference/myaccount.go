@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Every enrolled user has a personal account named after its certificate, so that end-user apps
+// never pass the paying entity as an argument. The "accountKeyMode" config key picks the name:
+// "name" for CN@org, the default, or "certHash" for the hex SHA-256 of the certificate subject
+// and issuer, which stays the same when the certificate is renewed but never collides across CAs.
+const (
+	accountKeyName     = "name"
+	accountKeyCertHash = "certHash"
+)
+
+func accountKeyMode(stub shim.ChaincodeStubInterface) (string, error) {
+	return configValue(stub, "accountKeyMode")
+}
+
+func checkAccountKeyMode(stub shim.ChaincodeStubInterface, name, value string) (string, error) {
+	if value != accountKeyName && value != accountKeyCertHash {
+		return "", fmt.Errorf("invalid account key mode %s, expecting name or certHash", value)
+	}
+	return value, nil
+}
+
+// certHash identifies the certificate holder by the subject and issuer of its certificate
+func (id *identity) certHash() string {
+	h := sha256.Sum256([]byte(id.Subject + "\x00" + id.Issuer))
+	return hex.EncodeToString(h[:])
+}
+
+// myAccount is the personal account of the caller
+func myAccount(stub shim.ChaincodeStubInterface) (string, error) {
+	id, err := getCreator(stub)
+	if err != nil {
+		return "", err
+	}
+	mode, err := accountKeyMode(stub)
+	if err != nil {
+		return "", err
+	}
+	if mode == accountKeyCertHash {
+		return id.certHash(), nil
+	}
+	return id.name(), nil
+}
+
+// the personal account of the caller with its balance and available balance
+func (t *SimpleChaincode) myBalance(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	account, err := myAccount(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	balance, _, err := getBalance(stub, account)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	available, _, err := availableBalance(stub, account, "")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	result := struct {
+		Account   string `json:"account"`
+		Balance   int    `json:"balance"`
+		Available int    `json:"available"`
+	}{account, balance, available}
+
+	resultBytes, err := json.Marshal(result)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(resultBytes)
+}
+
+// pays x units from the personal account of the caller: recipient and amount
+func (t *SimpleChaincode) pay(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		return pb.Response{Status: 403, Message: "Incorrect number of arguments. Expecting recipient and amount"}
+	}
+
+	x, err := parseAmount(args[1])
+	if err != nil {
+		return pb.Response{Status: 403, Message: err.Error()}
+	}
+	account, err := myAccount(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return moveUnits(stub, "pay", account, args[0], x)
+}
+
+// sets how personal accounts are named: "name" or "certHash"
+func (t *SimpleChaincode) setAccountKeyMode(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return pb.Response{Status: 403, Message: "Incorrect number of arguments. Expecting name or certHash"}
+	}
+
+	return changeConfig(stub, "accountKeyMode", args[0])
+}
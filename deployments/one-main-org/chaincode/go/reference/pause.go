@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// While the "pause" setting is set, Invoke only runs read-only functions of the registry and
+// those that lift the pause, anything else fails with status 503 and the reason of the pause.
+// Proposals may only be made and voted on for functions that run while paused, so that a quorum
+// can still unpause.
+const statusPaused = 503
+
+// pauseExempt are the functions changing state that still run while paused
+var pauseExempt = map[string]bool{"pause": true, "unpause": true, "propose": true, "approveProposal": true, "rejectProposal": true}
+
+type pauseState struct {
+	Reason   string `json:"reason"`
+	PausedBy string `json:"pausedBy"`
+	Since    int64  `json:"since"`
+}
+
+func checkPauseState(stub shim.ChaincodeStubInterface, name, value string) (string, error) {
+	p := &pauseState{}
+	if err := json.Unmarshal([]byte(value), p); err != nil {
+		return "", fmt.Errorf("invalid pause: %s", err)
+	}
+	if p.Reason == "" {
+		return "", fmt.Errorf("a pause needs a reason")
+	}
+	pauseBytes, err := json.Marshal(p)
+	return string(pauseBytes), err
+}
+
+// getPause returns the pause in force, nil when the chaincode runs normally
+func getPause(stub shim.ChaincodeStubInterface) (*pauseState, error) {
+	p := &pauseState{}
+	found, err := configJSON(stub, "pause", p)
+	if err != nil || !found {
+		return nil, err
+	}
+	return p, nil
+}
+
+// checkPaused fails with status 503 when the function may not run because of a pause
+func checkPaused(stub shim.ChaincodeStubInterface, function string) pb.Response {
+	if f, ok := functions[function]; ok && (f.readOnly || pauseExempt[function]) {
+		return shim.Success(nil)
+	}
+	p, err := getPause(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if p != nil {
+		return pb.Response{Status: statusPaused, Message: "Chaincode paused: " + p.Reason}
+	}
+	return shim.Success(nil)
+}
+
+// stops every function changing state until unpause: reason
+func (t *SimpleChaincode) pause(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 || args[0] == "" {
+		return pb.Response{Status: 403, Message: "Incorrect number of arguments. Expecting reason"}
+	}
+
+	id, err := getCreator(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	p := &pauseState{Reason: args[0], PausedBy: id.name()}
+	if p.Since, err = txTime(stub); err != nil {
+		return shim.Error(err.Error())
+	}
+	pauseBytes, err := json.Marshal(p)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return changeConfig(stub, "pause", string(pauseBytes))
+}
+
+// lets functions changing state run again
+func (t *SimpleChaincode) unpause(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	p, err := getPause(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if p == nil {
+		return pb.Response{Status: 409, Message: "Chaincode is not paused"}
+	}
+
+	return changeConfig(stub, "pause", "")
+}
+
+// tells whether the chaincode runs normally or is paused, and why
+func (t *SimpleChaincode) health(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	p, err := getPause(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	health := struct {
+		Status string      `json:"status"`
+		Pause  *pauseState `json:"pause,omitempty"`
+	}{"ok", p}
+	if p != nil {
+		health.Status = "paused"
+	}
+
+	healthBytes, err := json.Marshal(health)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(healthBytes)
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Access policies are boolean expressions over the creator identity kept under the config key
+// "policy:<function>". A function with a policy may be called by whoever satisfies it, the role of
+// the function registry only applies to functions without one. The language:
+//
+//	expr    = and { "||" and }
+//	and     = unary { "&&" unary }
+//	unary   = "!" unary | "(" expr ")" | "true" | "false" | operand ( "==" | "!=" ) operand | operand "in" list
+//	operand = string | org | mspId | cn | name | issuerOrg | role | ou | attr.<name>
+//	list    = "[" [ string { "," string } ] "]"
+//
+// role and ou hold every role and OU of the identity, == is true when any of them matches and in
+// when any of them is listed, a missing attribute holds nothing, e.g.
+// org in ["a","b"] && role == "admin" || attr.department == "treasury"
+const policyConfigPrefix = "policy:"
+
+type policy interface {
+	eval(id *identity) bool
+}
+
+type orPolicy struct{ left, right policy }
+type andPolicy struct{ left, right policy }
+type notPolicy struct{ p policy }
+type constPolicy bool
+type comparePolicy struct {
+	left, right operand
+	negate      bool
+}
+type inPolicy struct {
+	left operand
+	list []string
+}
+
+func (p orPolicy) eval(id *identity) bool    { return p.left.eval(id) || p.right.eval(id) }
+func (p andPolicy) eval(id *identity) bool   { return p.left.eval(id) && p.right.eval(id) }
+func (p notPolicy) eval(id *identity) bool   { return !p.p.eval(id) }
+func (p constPolicy) eval(id *identity) bool { return bool(p) }
+
+func (p comparePolicy) eval(id *identity) bool {
+	for _, l := range p.left(id) {
+		for _, r := range p.right(id) {
+			if l == r {
+				return !p.negate
+			}
+		}
+	}
+	return p.negate
+}
+
+func (p inPolicy) eval(id *identity) bool {
+	for _, l := range p.left(id) {
+		for _, r := range p.list {
+			if l == r {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// operand yields the values of an identity field, or a string literal
+type operand func(id *identity) []string
+
+var identityFields = map[string]operand{
+	"org":       func(id *identity) []string { return []string{id.Org} },
+	"mspId":     func(id *identity) []string { return []string{id.MSPID} },
+	"cn":        func(id *identity) []string { return []string{id.CommonName} },
+	"name":      func(id *identity) []string { return []string{id.name()} },
+	"issuerOrg": func(id *identity) []string { return []string{id.Organization} },
+	"role":      func(id *identity) []string { return id.roles() },
+	"ou":        func(id *identity) []string { return id.OUs },
+}
+
+// policyParser is a recursive descent parser over the tokens of an expression
+type policyParser struct {
+	tokens []string
+	pos    int
+}
+
+// tokenize splits an expression into strings, words and operators
+func tokenize(expr string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(expr); {
+		c := rune(expr[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '"':
+			j := i + 1
+			for ; j < len(expr) && expr[j] != '"'; j++ {
+				if expr[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(expr) {
+				return nil, fmt.Errorf("unterminated string at %d", i)
+			}
+			tokens = append(tokens, expr[i:j+1])
+			i = j + 1
+		case strings.HasPrefix(expr[i:], "&&"), strings.HasPrefix(expr[i:], "||"),
+			strings.HasPrefix(expr[i:], "=="), strings.HasPrefix(expr[i:], "!="):
+			tokens = append(tokens, expr[i:i+2])
+			i += 2
+		case strings.ContainsRune("!()[],", c):
+			tokens = append(tokens, string(c))
+			i++
+		case unicode.IsLetter(c):
+			j := i
+			for j < len(expr) && (unicode.IsLetter(rune(expr[j])) || unicode.IsDigit(rune(expr[j])) || strings.ContainsRune("._-", rune(expr[j]))) {
+				j++
+			}
+			tokens = append(tokens, expr[i:j])
+			i = j
+		default:
+			return nil, fmt.Errorf("unexpected %q at %d", c, i)
+		}
+	}
+	return tokens, nil
+}
+
+// parsePolicy compiles an expression of the policy language
+func parsePolicy(expr string) (policy, error) {
+	tokens, err := tokenize(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &policyParser{tokens: tokens}
+	result, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %s", p.tokens[p.pos])
+	}
+	return result, nil
+}
+
+func (p *policyParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *policyParser) next() string {
+	token := p.peek()
+	p.pos++
+	return token
+}
+
+func (p *policyParser) expect(token string) error {
+	if got := p.next(); got != token {
+		if got == "" {
+			got = "end of policy"
+		}
+		return fmt.Errorf("expecting %s, got %s", token, got)
+	}
+	return nil
+}
+
+func (p *policyParser) or() (policy, error) {
+	left, err := p.and()
+	for err == nil && p.peek() == "||" {
+		p.next()
+		var right policy
+		if right, err = p.and(); err == nil {
+			left = orPolicy{left, right}
+		}
+	}
+	return left, err
+}
+
+func (p *policyParser) and() (policy, error) {
+	left, err := p.unary()
+	for err == nil && p.peek() == "&&" {
+		p.next()
+		var right policy
+		if right, err = p.unary(); err == nil {
+			left = andPolicy{left, right}
+		}
+	}
+	return left, err
+}
+
+func (p *policyParser) unary() (policy, error) {
+	switch p.peek() {
+	case "!":
+		p.next()
+		inner, err := p.unary()
+		return notPolicy{inner}, err
+	case "(":
+		p.next()
+		inner, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		return inner, p.expect(")")
+	case "true", "false":
+		return constPolicy(p.next() == "true"), nil
+	}
+
+	left, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	switch op := p.next(); op {
+	case "==", "!=":
+		right, err := p.operand()
+		return comparePolicy{left, right, op == "!="}, err
+	case "in":
+		list, err := p.list()
+		return inPolicy{left, list}, err
+	default:
+		return nil, fmt.Errorf("expecting ==, != or in, got %q", op)
+	}
+}
+
+func (p *policyParser) operand() (operand, error) {
+	token := p.next()
+	if strings.HasPrefix(token, "\"") {
+		value, err := strconv.Unquote(token)
+		return func(*identity) []string { return []string{value} }, err
+	}
+	if strings.HasPrefix(token, "attr.") && len(token) > len("attr.") {
+		name := token[len("attr."):]
+		return func(id *identity) []string {
+			if value, ok := id.Attributes[name]; ok {
+				return []string{value}
+			}
+			return nil
+		}, nil
+	}
+	if field, ok := identityFields[token]; ok {
+		return field, nil
+	}
+	return nil, fmt.Errorf("unknown operand %q", token)
+}
+
+func (p *policyParser) list() ([]string, error) {
+	if err := p.expect("["); err != nil {
+		return nil, err
+	}
+	list := []string{}
+	for p.peek() != "]" {
+		if len(list) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		token := p.next()
+		value, err := strconv.Unquote(token)
+		if err != nil || !strings.HasPrefix(token, "\"") {
+			return nil, fmt.Errorf("expecting a string in the list, got %q", token)
+		}
+		list = append(list, value)
+	}
+	return list, p.expect("]")
+}
+
+// getPolicy returns the policy expression of a function, empty when it has none
+func getPolicy(stub shim.ChaincodeStubInterface, function string) (string, error) {
+	return configValue(stub, policyConfigPrefix+function)
+}
+
+func checkPolicy(stub shim.ChaincodeStubInterface, name, value string) (string, error) {
+	function := strings.TrimPrefix(name, policyConfigPrefix)
+	if _, ok := functions[function]; !ok {
+		return "", fmt.Errorf("function %s not found", function)
+	}
+	if _, err := parsePolicy(value); err != nil {
+		return "", fmt.Errorf("invalid policy: %s", err)
+	}
+	return strings.TrimSpace(value), nil
+}
+
+// allowed evaluates the policy of the function for the identity, or its registry role when it has
+// no policy, and tells what the function requires
+func (id *identity) allowed(stub shim.ChaincodeStubInterface, function string) (bool, string, error) {
+	f, ok := functions[function]
+	if !ok {
+		return false, "", nil
+	}
+	expr, err := getPolicy(stub, function)
+	if err != nil {
+		return false, "", err
+	}
+	if expr == "" {
+		return id.canInvoke(function), "role " + f.role, nil
+	}
+	p, err := parsePolicy(expr)
+	if err != nil {
+		return false, "", fmt.Errorf("policy of %s: %s", function, err)
+	}
+	return p.eval(id), "policy " + expr, nil
+}
+
+// sets the policy of a function, an empty policy reverts to the role of the function: function and policy
+func (t *SimpleChaincode) setPolicy(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		return pb.Response{Status: 403, Message: "Incorrect number of arguments. Expecting function and policy"}
+	}
+
+	if _, ok := functions[args[0]]; !ok {
+		return pb.Response{Status: 404, Message: "Function " + args[0] + " not found"}
+	}
+
+	return changeConfig(stub, policyConfigPrefix+args[0], strings.TrimSpace(args[1]))
+}
+
+// evaluates the policy of a function for the caller without calling it: function and optional
+// policy to try instead of the one set
+func (t *SimpleChaincode) evaluatePolicy(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 1 || len(args) > 2 {
+		return pb.Response{Status: 403, Message: "Incorrect number of arguments. Expecting function and optional policy"}
+	}
+
+	function := args[0]
+	f, ok := functions[function]
+	if !ok {
+		return pb.Response{Status: 404, Message: "Function " + function + " not found"}
+	}
+	id, err := getCreator(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	evaluation := struct {
+		Function string `json:"function"`
+		Identity string `json:"identity"`
+		Policy   string `json:"policy,omitempty"`
+		Role     string `json:"role,omitempty"`
+		Allowed  bool   `json:"allowed"`
+	}{Function: function, Identity: id.name()}
+
+	if len(args) == 2 {
+		evaluation.Policy = strings.TrimSpace(args[1])
+	} else if evaluation.Policy, err = getPolicy(stub, function); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if evaluation.Policy == "" {
+		evaluation.Role = f.role
+		evaluation.Allowed = id.canInvoke(function)
+	} else {
+		p, err := parsePolicy(evaluation.Policy)
+		if err != nil {
+			return pb.Response{Status: 403, Message: "Invalid policy: " + err.Error()}
+		}
+		evaluation.Allowed = p.eval(id)
+	}
+
+	evaluationBytes, err := json.Marshal(evaluation)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(evaluationBytes)
+}
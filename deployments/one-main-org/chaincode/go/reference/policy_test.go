@@ -0,0 +1,156 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+var policyTestIdentity = &identity{
+	MSPID:        "AMSP",
+	CommonName:   "alice",
+	Organization: "a.example.com",
+	Org:          "a",
+	OUs:          []string{"client", "admin"},
+	Attributes:   map[string]string{"department": "treasury", "role": "issuer"},
+}
+
+func TestPolicyEval(t *testing.T) {
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{`true`, true},
+		{`false`, false},
+		{`org == "a"`, true},
+		{`"a" == org`, true},
+		{`org != "a"`, false},
+		{`mspId == "AMSP" && cn == "alice" && name == "alice@a" && issuerOrg == "a.example.com"`, true},
+
+		// precedence: ! binds tighter than &&, && tighter than ||
+		{`true || false && false`, true},
+		{`false && true || true`, true},
+		{`(true || false) && false`, false},
+		{`!true || true`, true},
+		{`!(true || true)`, false},
+		{`!!true`, true},
+		{`org == "b" || role == "admin" && attr.department == "ops"`, false},
+		{`(org == "b" || role == "admin") && attr.department == "treasury"`, true},
+
+		// lists
+		{`org in ["b", "a"]`, true},
+		{`org in ["b"]`, false},
+		{`org in []`, false},
+		{`cn in ["al\"ice", "alice"]`, true},
+
+		// role and ou hold many values, a missing attribute none
+		{`role == "admin"`, true},
+		{`role == "issuer"`, true},
+		{`role in ["auditor", "issuer"]`, true},
+		{`role != "admin"`, false},
+		{`ou == "issuer"`, false},
+		{`ou in ["client"]`, true},
+		{`attr.department == "treasury"`, true},
+		{`attr.missing == ""`, false},
+		{`attr.missing != "x"`, true},
+		{`attr.missing in [""]`, false},
+	}
+	for _, test := range tests {
+		p, err := parsePolicy(test.expr)
+		if err != nil {
+			t.Errorf("parsePolicy(%s): %s", test.expr, err)
+			continue
+		}
+		if got := p.eval(policyTestIdentity); got != test.want {
+			t.Errorf("%s = %t, expected %t", test.expr, got, test.want)
+		}
+	}
+}
+
+func TestPolicyErrors(t *testing.T) {
+	tests := []struct {
+		expr, err string
+	}{
+		{``, `unknown operand ""`},
+		{`org`, `expecting ==, != or in`},
+		{`org ==`, `unknown operand ""`},
+		{`org = "a"`, `unexpected '='`},
+		{`org == "a`, `unterminated string`},
+		{`org == a`, `unknown operand "a"`},
+		{`foo == "a"`, `unknown operand "foo"`},
+		{`attr. == "a"`, `unknown operand "attr."`},
+		{`org in "a"`, `expecting [`},
+		{`org in ["a",]`, `expecting a string in the list`},
+		{`org in ["a" "b"]`, `expecting ,`},
+		{`org in [a]`, `expecting a string in the list`},
+		{`org in ["a"`, `got end of policy`},
+		{`(org == "a"`, `expecting ), got end of policy`},
+		{`org == "a")`, `unexpected )`},
+		{`org == "a" &&`, `unknown operand ""`},
+		{`org == "a" || || true`, `unknown operand "||"`},
+		{`!`, `unknown operand ""`},
+		{`org == "a" $`, `unexpected '$'`},
+	}
+	for _, test := range tests {
+		_, err := parsePolicy(test.expr)
+		if err == nil {
+			t.Errorf("parsePolicy(%s) succeeded, expected %s", test.expr, test.err)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.err) {
+			t.Errorf("parsePolicy(%s): %s, expected %s", test.expr, err, test.err)
+		}
+	}
+}
+
+func TestPolicyAllowed(t *testing.T) {
+	l := newMockLedger()
+	l.setConfig(policyConfigPrefix+"burn", `org == "b" || attr.department == "treasury"`)
+	l.setConfig(policyConfigPrefix+"setLogging", `org == "b"`)
+	l.setConfig(policyConfigPrefix+"compact", `org ==`)
+	stub := l.tx("tx", nil)
+
+	auditor := &identity{Org: "c", CommonName: "bob", Attributes: map[string]string{}}
+	tests := []struct {
+		id          *identity
+		function    string
+		allowed     bool
+		requirement string
+	}{
+		// the registry role applies while a function has no policy
+		{policyTestIdentity, "mint", true, "role issuer"},
+		{auditor, "mint", false, "role issuer"},
+		{auditor, "query", true, "role "},
+		// a policy replaces the role, whether it grants more or less
+		{policyTestIdentity, "burn", true, `policy org == "b" || attr.department == "treasury"`},
+		{auditor, "burn", false, `policy org == "b" || attr.department == "treasury"`},
+		{policyTestIdentity, "setLogging", false, `policy org == "b"`},
+		{policyTestIdentity, "unknown", false, ""},
+	}
+	for _, test := range tests {
+		allowed, requirement, err := test.id.allowed(stub, test.function)
+		if err != nil {
+			t.Errorf("%s allowed %s: %s", test.id.name(), test.function, err)
+			continue
+		}
+		if allowed != test.allowed || requirement != test.requirement {
+			t.Errorf("%s allowed %s = %t, %q, expected %t, %q", test.id.name(), test.function, allowed, requirement, test.allowed, test.requirement)
+		}
+	}
+
+	if _, _, err := policyTestIdentity.allowed(stub, "compact"); err == nil {
+		t.Error("a broken policy on the ledger allowed the call")
+	}
+}
+
+func TestCheckPolicy(t *testing.T) {
+	stub := newMockLedger().tx("tx", nil)
+	if value, err := checkPolicy(stub, policyConfigPrefix+"mint", `  org == "a" `); err != nil || value != `org == "a"` {
+		t.Errorf("checkPolicy = %q, %v", value, err)
+	}
+	if _, err := checkPolicy(stub, policyConfigPrefix+"nothing", `true`); err == nil {
+		t.Error("policy of an unknown function accepted")
+	}
+	if _, err := checkPolicy(stub, policyConfigPrefix+"mint", `org in`); err == nil {
+		t.Error("invalid policy accepted")
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Once a quorum rule is set under the "quorum" config key, privileged functions no longer run on
+// the call of a single org. Anyone allowed to call the function proposes it with its arguments,
+// admins of the orgs of the rule approve or reject it, one vote per org, and the approval meeting
+// the threshold executes the function in its own transaction. Should the function fail there, the
+// approval fails with it and can be given again. Proposals live under proposal~id, the id being
+// the transaction that proposed it, and keep every vote for audit.
+const proposalObjectType = "proposal"
+
+const defaultProposalLifetime = 7 * 24 * 60 * 60 // seconds
+
+const (
+	proposalPending  = "pending"
+	proposalExecuted = "executed"
+	proposalRejected = "rejected"
+	proposalExpired  = "expired"
+)
+
+// quorumRule is kept under the "quorum" config key
+type quorumRule struct {
+	Orgs      []string `json:"orgs"`
+	Threshold int      `json:"threshold"`
+}
+
+func (q *quorumRule) validate() error {
+	if len(q.Orgs) == 0 {
+		return fmt.Errorf("a quorum needs at least one org")
+	}
+	seen := map[string]bool{}
+	for _, org := range q.Orgs {
+		if org == "" || seen[org] {
+			return fmt.Errorf("orgs must be distinct and not empty")
+		}
+		seen[org] = true
+	}
+	if q.Threshold < 1 || q.Threshold > len(q.Orgs) {
+		return fmt.Errorf("threshold must be between 1 and %d", len(q.Orgs))
+	}
+	return nil
+}
+
+func (q *quorumRule) member(org string) bool {
+	for _, o := range q.Orgs {
+		if o == org {
+			return true
+		}
+	}
+	return false
+}
+
+type vote struct {
+	Org      string `json:"org"`
+	Identity string `json:"identity"`
+	Approve  bool   `json:"approve"`
+	At       int64  `json:"at"`
+	TxID     string `json:"txId"`
+}
+
+type proposal struct {
+	ID         string     `json:"id"`
+	Function   string     `json:"function"`
+	Args       []string   `json:"args"`
+	ProposedBy string     `json:"proposedBy"`
+	Created    int64      `json:"created"`
+	Expires    int64      `json:"expires"`
+	Status     string     `json:"status"`
+	Quorum     quorumRule `json:"quorum"` // the rule in force when the proposal was made
+	Votes      []vote     `json:"votes"`
+	Result     *result    `json:"result,omitempty"`
+}
+
+// result is the response of an executed proposal
+type result struct {
+	Status  int32  `json:"status"`
+	Message string `json:"message,omitempty"`
+	Payload string `json:"payload,omitempty"`
+}
+
+// tally counts the approving and rejecting orgs
+func (p *proposal) tally() (approvals int, rejections int) {
+	for _, v := range p.Votes {
+		if v.Approve {
+			approvals++
+		} else {
+			rejections++
+		}
+	}
+	return approvals, rejections
+}
+
+func (p *proposal) voted(org string) bool {
+	for _, v := range p.Votes {
+		if v.Org == org {
+			return true
+		}
+	}
+	return false
+}
+
+// getQuorum returns the quorum rule, nil when privileged functions run on a single call
+func getQuorum(stub shim.ChaincodeStubInterface) (*quorumRule, error) {
+	q := &quorumRule{}
+	found, err := configJSON(stub, "quorum", q)
+	if err != nil || !found {
+		return nil, err
+	}
+	return q, nil
+}
+
+func checkQuorum(stub shim.ChaincodeStubInterface, name, value string) (string, error) {
+	q := &quorumRule{}
+	if err := json.Unmarshal([]byte(value), q); err != nil {
+		return "", fmt.Errorf("invalid quorum rule: %s", err)
+	}
+	if err := q.validate(); err != nil {
+		return "", err
+	}
+	ruleBytes, err := json.Marshal(q)
+	return string(ruleBytes), err
+}
+
+func getProposal(stub shim.ChaincodeStubInterface, proposalID string) (*proposal, error) {
+	p := &proposal{}
+	found, err := getJSON(stub, proposalObjectType, []string{proposalID}, p)
+	if err != nil || !found {
+		return nil, err
+	}
+	return p, nil
+}
+
+func putProposal(stub shim.ChaincodeStubInterface, event string, p *proposal) pb.Response {
+	if err := putJSON(stub, proposalObjectType, []string{p.ID}, p); err != nil {
+		return shim.Error(err.Error())
+	}
+	proposalBytes, err := json.Marshal(p)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if event != "" {
+		if err = stub.SetEvent(event, proposalBytes); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	return shim.Success(proposalBytes)
+}
+
+// castVote records the vote of the caller org and executes the proposal once approved
+func (t *SimpleChaincode) castVote(stub shim.ChaincodeStubInterface, p *proposal, approve bool) pb.Response {
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if p.Status == proposalPending && now >= p.Expires {
+		p.Status = proposalExpired
+	}
+	if p.Status != proposalPending {
+		return pb.Response{Status: 403, Message: "Proposal is " + p.Status}
+	}
+
+	id, err := getCreator(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !p.Quorum.member(id.Org) || !id.hasRole("admin") {
+		return pb.Response{Status: 403, Message: "Only admins of " + fmt.Sprint(p.Quorum.Orgs) + " may vote"}
+	}
+	if p.voted(id.Org) {
+		return pb.Response{Status: 409, Message: "Org " + id.Org + " already voted"}
+	}
+	p.Votes = append(p.Votes, vote{id.Org, id.name(), approve, now, stub.GetTxID()})
+
+	approvals, rejections := p.tally()
+	if len(p.Quorum.Orgs)-rejections < p.Quorum.Threshold {
+		p.Status = proposalRejected
+		return putProposal(stub, "rejectProposal", p)
+	}
+	if approvals < p.Quorum.Threshold {
+		return putProposal(stub, "approveProposal", p)
+	}
+
+	// the function sends its own event, if any
+	response := functions[p.Function].handler(t, stub, p.Args)
+	if response.Status >= shim.ERRORTHRESHOLD {
+		return response
+	}
+	p.Status = proposalExecuted
+	p.Result = &result{response.Status, response.Message, string(response.Payload)}
+	return putProposal(stub, "", p)
+}
+
+// proposes a privileged call: function, arguments as a json array and expiry, empty for the
+// default lifetime, so that a request id can only follow it
+func (t *SimpleChaincode) propose(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return pb.Response{Status: 403, Message: "Incorrect number of arguments. Expecting function, arguments as json and expiry, empty for the default"}
+	}
+
+	q, err := getQuorum(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if q == nil {
+		return pb.Response{Status: 403, Message: "No quorum rule set, call the function directly"}
+	}
+
+	f, ok := functions[args[0]]
+	if !ok || !f.quorum {
+		return pb.Response{Status: 403, Message: "Function " + args[0] + " does not need a proposal"}
+	}
+	if response := checkPaused(stub, args[0]); response.Status >= shim.ERRORTHRESHOLD {
+		return response
+	}
+	id, err := getCreator(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	allowed, requirement, err := id.allowed(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !allowed {
+		return pb.Response{Status: 403, Message: "Function " + args[0] + " requires " + requirement}
+	}
+
+	p := &proposal{ID: stub.GetTxID(), Function: args[0], ProposedBy: id.name(), Status: proposalPending, Quorum: *q, Votes: []vote{}}
+	if err = json.Unmarshal([]byte(args[1]), &p.Args); err != nil {
+		return pb.Response{Status: 403, Message: "Invalid arguments, expecting a json array of strings: " + err.Error()}
+	}
+	if p.Created, err = txTime(stub); err != nil {
+		return shim.Error(err.Error())
+	}
+	p.Expires = p.Created + defaultProposalLifetime
+	if args[2] != "" {
+		if p.Expires, err = parseExpiry(args[2]); err != nil {
+			return pb.Response{Status: 403, Message: err.Error()}
+		}
+		if p.Expires <= p.Created {
+			return pb.Response{Status: 403, Message: "Expiry must be in the future"}
+		}
+	}
+
+	// an admin of a quorum org proposing approves at the same time
+	if q.member(id.Org) && id.hasRole("admin") {
+		return t.castVote(stub, p, true)
+	}
+
+	return putProposal(stub, "propose", p)
+}
+
+// approves a proposal for the org of the caller: proposal id
+func (t *SimpleChaincode) approveProposal(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	return t.vote(stub, args, true)
+}
+
+// rejects a proposal for the org of the caller: proposal id
+func (t *SimpleChaincode) rejectProposal(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	return t.vote(stub, args, false)
+}
+
+func (t *SimpleChaincode) vote(stub shim.ChaincodeStubInterface, args []string, approve bool) pb.Response {
+	if len(args) != 1 {
+		return pb.Response{Status: 403, Message: "Incorrect number of arguments. Expecting proposal id"}
+	}
+
+	p, err := getProposal(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if p == nil {
+		return pb.Response{Status: 404, Message: "Proposal not found"}
+	}
+	if response := checkPaused(stub, p.Function); response.Status >= shim.ERRORTHRESHOLD {
+		return response
+	}
+
+	return t.castVote(stub, p, approve)
+}
+
+// proposals with their votes, oldest first: optional status
+func (t *SimpleChaincode) proposals(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) > 1 {
+		return pb.Response{Status: 403, Message: "Incorrect number of arguments. Expecting optional status"}
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	it, err := stub.GetStateByPartialCompositeKey(proposalObjectType, []string{})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer it.Close()
+
+	proposals := []proposal{}
+	for it.HasNext() {
+		kv, err := it.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		var p proposal
+		if err = openJSON(stub, kv.Key, kv.Value, &p); err != nil {
+			return shim.Error(err.Error())
+		}
+		if p.Status == proposalPending && now >= p.Expires {
+			p.Status = proposalExpired
+		}
+		if len(args) == 0 || args[0] == "" || p.Status == args[0] {
+			proposals = append(proposals, p)
+		}
+	}
+	sort.SliceStable(proposals, func(i, j int) bool {
+		return proposals[i].Created < proposals[j].Created
+	})
+
+	proposalsBytes, err := json.Marshal(proposals)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(proposalsBytes)
+}
+
+// sets the quorum rule as json, e.g. {"orgs":["a","b","c"],"threshold":2}
+func (t *SimpleChaincode) setQuorum(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return pb.Response{Status: 403, Message: "Incorrect number of arguments. Expecting quorum rule as json"}
+	}
+
+	return changeConfig(stub, "quorum", args[0])
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Clients retrying a mutating call pass the same request id as an extra last argument. The outcome of
+// the first successful call is kept under request~caller~id and returned again to retries of the same
+// caller within the retention window instead of executing the call twice. Request ids are scoped to
+// the caller, so two clients choosing the same id never see each other's outcome.
+const requestObjectType = "request"
+
+const defaultRequestRetention = 24 * 60 * 60 // seconds
+
+type requestRecord struct {
+	Function   string `json:"function"`
+	ArgsHash   string `json:"argsHash"`
+	TxID       string `json:"txId"`
+	Timestamp  int64  `json:"timestamp"`
+	Status     int32  `json:"status"`
+	Message    string `json:"message,omitempty"`
+	Payload    []byte `json:"payload,omitempty"`
+	ResultHash string `json:"resultHash"`
+}
+
+func hashArgs(caller, function string, args []string) string {
+	h := sha256.Sum256([]byte(caller + "\x00" + function + "\x00" + strings.Join(args, "\x00")))
+	return hex.EncodeToString(h[:])
+}
+
+func hashResult(response pb.Response) string {
+	h := sha256.New()
+	h.Write([]byte(strconv.Itoa(int(response.Status)) + "\x00" + response.Message + "\x00"))
+	h.Write(response.Payload)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func requestRetention(stub shim.ChaincodeStubInterface) (int64, error) {
+	return configInt(stub, "requestRetention")
+}
+
+// getRequest returns the record of a request id of the caller, nil when there is none
+func getRequest(stub shim.ChaincodeStubInterface, caller, requestID string) (*requestRecord, error) {
+	record := &requestRecord{}
+	found, err := getJSON(stub, requestObjectType, []string{caller, requestID}, record)
+	if err != nil || !found {
+		return nil, err
+	}
+	return record, nil
+}
+
+// idempotent runs call once per client request id: a retry with the same arguments gets the recorded
+// outcome back, reusing the id for different arguments is refused until the record expires
+func idempotent(stub shim.ChaincodeStubInterface, function string, requestID string, args []string, call func() pb.Response) pb.Response {
+	if requestID == "" {
+		return pb.Response{Status: 403, Message: "Empty request id"}
+	}
+
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	retention, err := requestRetention(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	id, err := getCreator(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	caller := id.name()
+	argsHash := hashArgs(caller, function, args)
+
+	record, err := getRequest(stub, caller, requestID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if record != nil && ts.Seconds-record.Timestamp < retention {
+		if record.ArgsHash != argsHash {
+			return pb.Response{Status: 409, Message: "Request id " + requestID + " was already used for a different request"}
+		}
+		txLog(stub).Infof("request %s already executed in transaction %s", requestID, record.TxID)
+		return pb.Response{Status: record.Status, Message: record.Message, Payload: record.Payload}
+	}
+
+	response := call()
+	if response.Status >= shim.ERRORTHRESHOLD {
+		// nothing is committed for a failed call, so there is nothing to remember either
+		return response
+	}
+
+	record = &requestRecord{
+		Function:   function,
+		ArgsHash:   argsHash,
+		TxID:       stub.GetTxID(),
+		Timestamp:  ts.Seconds,
+		Status:     response.Status,
+		Message:    response.Message,
+		Payload:    response.Payload,
+		ResultHash: hashResult(response),
+	}
+	err = putJSON(stub, requestObjectType, []string{caller, requestID}, record)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return response
+}
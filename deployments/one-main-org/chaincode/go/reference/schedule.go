@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// A scheduled transfer takes the funds off the payer when it is made and keeps them in escrow
+// under schedule~id, the id being the transaction that made it, until executeDue pays them to
+// the payee once the release time has passed, or the payer cancels it before. A release counts
+// against the velocity limits of the payer and of the org that scheduled it, whoever executes
+// it, a schedule it would take over a limit waits for a later execution. The fee of scheduleMove
+// is set when the transfer is made and paid to the collector on release, a cancelled transfer
+// returns the whole amount. Escrowed funds still count in the total supply.
+const scheduleObjectType = "schedule"
+
+type schedule struct {
+	ID          string `json:"id"`
+	From        string `json:"from"`
+	To          string `json:"to"`
+	Amount      int    `json:"amount"`
+	Fee         int    `json:"fee,omitempty"` // part of the amount paid to the collector
+	Collector   string `json:"collector,omitempty"`
+	Release     int64  `json:"release"` // unix seconds
+	ScheduledBy string `json:"scheduledBy"`
+}
+
+func (s *schedule) due(now int64) bool {
+	return now >= s.Release
+}
+
+// pendingSchedulesOf lists the schedules in escrow sorted by release time, of all entities
+// when entity is empty or else of those paying or paid by it
+func pendingSchedulesOf(stub shim.ChaincodeStubInterface, entity string) ([]schedule, error) {
+	it, err := stub.GetStateByPartialCompositeKey(scheduleObjectType, []string{})
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+
+	schedules := []schedule{}
+	for it.HasNext() {
+		kv, err := it.Next()
+		if err != nil {
+			return nil, err
+		}
+		var s schedule
+		if err = openJSON(stub, kv.Key, kv.Value, &s); err != nil {
+			return nil, err
+		}
+		if entity == "" || s.From == entity || s.To == entity {
+			schedules = append(schedules, s)
+		}
+	}
+
+	sort.SliceStable(schedules, func(i, j int) bool {
+		return schedules[i].Release < schedules[j].Release
+	})
+	return schedules, nil
+}
+
+// escrowed sums the funds held by pending schedules
+func escrowed(stub shim.ChaincodeStubInterface) (int, error) {
+	schedules, err := pendingSchedulesOf(stub, "")
+	if err != nil {
+		return 0, err
+	}
+	sum := 0
+	for _, s := range schedules {
+		sum += s.Amount
+	}
+	return sum, nil
+}
+
+func deleteSchedule(stub shim.ChaincodeStubInterface, id string) error {
+	key, err := stub.CreateCompositeKey(scheduleObjectType, []string{id})
+	if err != nil {
+		return err
+	}
+	return stub.DelState(key)
+}
+
+// escrows x units of an entity until a release time: payer, payee, amount and release time
+func (t *SimpleChaincode) scheduleMove(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 4 {
+		return pb.Response{Status: 403, Message: "Incorrect number of arguments. Expecting payer, payee, amount and release time"}
+	}
+
+	x, err := parseAmount(args[2])
+	if err != nil {
+		return pb.Response{Status: 403, Message: err.Error()}
+	}
+	release, err := parseExpiry(args[3])
+	if err != nil || release == 0 {
+		return pb.Response{Status: 403, Message: "Invalid release time, expecting unix seconds or RFC 3339 time"}
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if release <= now {
+		return pb.Response{Status: 403, Message: "Release time must be after the transaction time " + strconv.FormatInt(now, 10)}
+	}
+
+	id, err := getCreator(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	s := &schedule{ID: stub.GetTxID(), From: args[0], To: args[1], Amount: x, Release: release, ScheduledBy: id.name()}
+	e, err := itemise(stub, "scheduleMove", s.From, s.To, x)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if e.Net <= 0 {
+		return pb.Response{Status: 403, Message: fmt.Sprintf("Amount %d does not cover the fee of %d", e.Value, e.Fee)}
+	}
+	s.Fee, s.Collector = e.Fee, e.Collector
+
+	// Callers not owning the payer spend from the allowance it gave them
+	if !id.owns(s.From) {
+		if response := spendAllowance(stub, s.From, id.name(), x); response.Status >= shim.ERRORTHRESHOLD {
+			return response
+		}
+	}
+
+	available, found, err := availableBalance(stub, s.From, "")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !found {
+		return pb.Response{Status: 404, Message: "Entity not found"}
+	}
+	if available < x {
+		return pb.Response{Status: 403, Message: fmt.Sprintf("Insufficient funds: %s has %d available", s.From, available)}
+	}
+
+	if err = applyChanges(stub, map[string]int{s.From: -x}); err != nil {
+		return errorResponse(err)
+	}
+	if err = putJSON(stub, scheduleObjectType, []string{s.ID}, s); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	scheduleBytes, err := json.Marshal(s)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err = stub.SetEvent("scheduleMove", scheduleBytes); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(scheduleBytes)
+}
+
+// pays out the schedules whose release time has passed to active payees, at most the given number when one is given
+func (t *SimpleChaincode) executeDue(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) > 1 {
+		return pb.Response{Status: 403, Message: "Incorrect number of arguments. Expecting optional maximum number of schedules"}
+	}
+
+	limit := 0
+	if len(args) == 1 && args[0] != "" {
+		var err error
+		if limit, err = parseAmount(args[0]); err != nil {
+			return pb.Response{Status: 403, Message: err.Error()}
+		}
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	schedules, err := pendingSchedulesOf(stub, "")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	executed := []schedule{}
+	changes := map[string]int{}
+	fees := map[string]int{}
+	sent, orgs := map[string]int{}, map[string]int{}
+	for _, s := range schedules {
+		if !s.due(now) || (limit > 0 && len(executed) == limit) {
+			break
+		}
+		// payees that are not active keep their schedules until they are again
+		if err = checkActive(stub, s.To); err != nil {
+			if _, ok := err.(*statusError); ok {
+				continue
+			}
+			return shim.Error(err.Error())
+		}
+		// as do schedules of payers that reached a limit
+		sent[s.From] += s.Amount
+		orgs[orgOf(s.ScheduledBy)] += s.Amount
+		_, response := checkVelocity(stub, sent, orgs)
+		if response.Status == statusLimitExceeded {
+			sent[s.From] -= s.Amount
+			orgs[orgOf(s.ScheduledBy)] -= s.Amount
+			continue
+		}
+		if response.Status >= shim.ERRORTHRESHOLD {
+			return response
+		}
+
+		found, err := entityExists(stub, s.To)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if !found && changes[s.To] == 0 {
+			if err = writeAmount(stub, s.To, 0); err != nil {
+				return shim.Error(err.Error())
+			}
+		}
+		if err = deleteSchedule(stub, s.ID); err != nil {
+			return shim.Error(err.Error())
+		}
+		changes[s.To] += s.Amount - s.Fee
+		fees[s.Collector] += s.Fee
+		executed = append(executed, s)
+	}
+
+	if response := spendVelocity(stub, sent, orgs); response.Status >= shim.ERRORTHRESHOLD {
+		return response
+	}
+	if err = applyChanges(stub, changes); err != nil {
+		return errorResponse(err)
+	}
+	if err = creditFees(stub, fees); err != nil {
+		return errorResponse(err)
+	}
+
+	executedBytes, err := json.Marshal(executed)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if len(executed) > 0 {
+		if err = stub.SetEvent("executeDue", executedBytes); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	return shim.Success(executedBytes)
+}
+
+// returns the escrowed funds of a schedule to the payer before its release time: schedule id
+func (t *SimpleChaincode) cancelSchedule(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return pb.Response{Status: 403, Message: "Incorrect number of arguments. Expecting schedule id"}
+	}
+
+	s := &schedule{}
+	found, err := getJSON(stub, scheduleObjectType, []string{args[0]}, s)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !found {
+		return pb.Response{Status: 404, Message: "Schedule not found"}
+	}
+
+	id, err := getCreator(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !id.owns(s.From) {
+		return pb.Response{Status: 403, Message: "Only the owner of " + s.From + " may cancel the schedule"}
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if s.due(now) {
+		return pb.Response{Status: 403, Message: "Schedule was released at " + strconv.FormatInt(s.Release, 10)}
+	}
+
+	if err = deleteSchedule(stub, s.ID); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err = applyChanges(stub, map[string]int{s.From: s.Amount}); err != nil {
+		return errorResponse(err)
+	}
+
+	scheduleBytes, err := json.Marshal(s)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err = stub.SetEvent("cancelSchedule", scheduleBytes); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(scheduleBytes)
+}
+
+// schedules in escrow by release time: optional entity paying or paid by them
+func (t *SimpleChaincode) pendingSchedules(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) > 1 {
+		return pb.Response{Status: 403, Message: "Incorrect number of arguments. Expecting optional entity"}
+	}
+
+	entity := ""
+	if len(args) == 1 {
+		entity = args[0]
+	}
+	schedules, err := pendingSchedulesOf(stub, entity)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	schedulesBytes, err := json.Marshal(schedules)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(schedulesBytes)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Value enters the ledger through Init and mint and leaves it through burn only, the total
+// is kept under the supply key and must always equal the sum of all balances.
+const supplyObjectType = "supply"
+
+func getSupply(stub shim.ChaincodeStubInterface) (supply int, found bool, err error) {
+	found, err = getJSON(stub, supplyObjectType, []string{}, &supply)
+	return supply, found, err
+}
+
+func putSupply(stub shim.ChaincodeStubInterface, supply int) error {
+	return putJSON(stub, supplyObjectType, []string{}, supply)
+}
+
+// sumBalances adds up the balances of all entities with their pending deltas and the escrowed funds
+func sumBalances(stub shim.ChaincodeStubInterface) (sum int, entities int, err error) {
+	// composite keys are outside of the range of simple keys, so this only sees balance keys
+	it, err := stub.GetStateByRange("", "")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer it.Close()
+	for it.HasNext() {
+		kv, err := it.Next()
+		if err != nil {
+			return 0, 0, err
+		}
+		balance, err := openAmount(stub, kv.Key, kv.Value)
+		if err != nil {
+			return 0, 0, err
+		}
+		sum += balance
+		entities++
+	}
+
+	deltas, err := stub.GetStateByPartialCompositeKey(deltaObjectType, []string{})
+	if err != nil {
+		return 0, 0, err
+	}
+	defer deltas.Close()
+	for deltas.HasNext() {
+		kv, err := deltas.Next()
+		if err != nil {
+			return 0, 0, err
+		}
+		delta, err := openAmount(stub, kv.Key, kv.Value)
+		if err != nil {
+			return 0, 0, err
+		}
+		sum += delta
+	}
+
+	// funds of scheduled transfers and swap offers have left the payer but not reached the payee yet
+	scheduled, err := escrowed(stub)
+	if err != nil {
+		return 0, 0, err
+	}
+	offered, err := swapEscrowed(stub)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return sum + scheduled + offered, entities, nil
+}
+
+// adjustSupply adds amount to the total supply, the first call on a ledger predating
+// the supply record takes the sum of the existing balances as the starting point
+func adjustSupply(stub shim.ChaincodeStubInterface, amount int) error {
+	supply, found, err := getSupply(stub)
+	if err != nil {
+		return err
+	}
+	if !found {
+		if supply, _, err = sumBalances(stub); err != nil {
+			return err
+		}
+	}
+	return putSupply(stub, supply+amount)
+}
+
+func parseAmount(amount string) (int, error) {
+	x, err := strconv.Atoi(amount)
+	if err != nil || x <= 0 {
+		return 0, fmt.Errorf("invalid amount %s, expecting a positive integer", amount)
+	}
+	return x, nil
+}
+
+// creates x units on an entity, creating the entity if needed
+func (t *SimpleChaincode) mint(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		return pb.Response{Status: 403, Message: "Incorrect number of arguments. Expecting entity and amount"}
+	}
+
+	a := args[0]
+	x, err := parseAmount(args[1])
+	if err != nil {
+		return pb.Response{Status: 403, Message: err.Error()}
+	}
+
+	found, err := entityExists(stub, a)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !found {
+		if err = writeAmount(stub, a, 0); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	if err = applyChanges(stub, map[string]int{a: x}); err != nil {
+		return errorResponse(err)
+	}
+	if err = adjustSupply(stub, x); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return supplyEvent(stub, "mint", a, x)
+}
+
+// destroys x units of an entity
+func (t *SimpleChaincode) burn(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		return pb.Response{Status: 403, Message: "Incorrect number of arguments. Expecting entity and amount"}
+	}
+
+	a := args[0]
+	x, err := parseAmount(args[1])
+	if err != nil {
+		return pb.Response{Status: 403, Message: err.Error()}
+	}
+
+	available, found, err := availableBalance(stub, a, "")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !found {
+		return pb.Response{Status: 404, Message: "Entity not found"}
+	}
+	if available < x {
+		return pb.Response{Status: 403, Message: fmt.Sprintf("Insufficient funds: %s has %d available", a, available)}
+	}
+
+	if err = applyChanges(stub, map[string]int{a: -x}); err != nil {
+		return errorResponse(err)
+	}
+	if err = adjustSupply(stub, -x); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return supplyEvent(stub, "burn", a, x)
+}
+
+func supplyEvent(stub shim.ChaincodeStubInterface, name string, entity string, amount int) pb.Response {
+	eventBytes, err := json.Marshal(map[string]interface{}{"entity": entity, "amount": amount, "txId": stub.GetTxID()})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err = stub.SetEvent(name, eventBytes); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(eventBytes)
+}
+
+// the recorded total supply
+func (t *SimpleChaincode) totalSupply(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	supply, _, err := getSupply(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success([]byte(strconv.Itoa(supply)))
+}
+
+// compares the recorded total supply with the sum of all balances
+func (t *SimpleChaincode) checkSupply(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	supply, recorded, err := getSupply(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	sum, entities, err := sumBalances(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	check := struct {
+		Supply   int  `json:"supply"`
+		Recorded bool `json:"recorded"`
+		Sum      int  `json:"sum"`
+		Entities int  `json:"entities"`
+		Balanced bool `json:"balanced"`
+	}{supply, recorded, sum, entities, recorded && supply == sum}
+
+	checkBytes, err := json.Marshal(check)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(checkBytes)
+}
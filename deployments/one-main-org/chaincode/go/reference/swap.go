@@ -0,0 +1,338 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// A swap exchanges two assets delivery versus payment. The maker offers an amount of one asset for
+// an amount of another, the offered amount is taken off the maker into escrow when the offer is
+// made. Accepting pays the asked amount from the taker to the maker and the escrow to the taker in
+// the same transaction. Offers live under swap~id, the id being the transaction that made the offer,
+// until they are accepted or cancelled; an offer that expired can no longer be accepted and anyone
+// may cancel it to return the escrow. The token legs of an accepted swap pay the fee of acceptSwap
+// like a move, its payer bearing it, and count against the velocity limits of the payer.
+const swapObjectType = "swap"
+
+type swapOffer struct {
+	ID          string `json:"id"`
+	Maker       string `json:"maker"`
+	GiveAsset   string `json:"giveAsset"`
+	GiveAmount  int    `json:"giveAmount"`
+	WantAsset   string `json:"wantAsset"`
+	WantAmount  int    `json:"wantAmount"`
+	GiveToken   bool   `json:"giveToken,omitempty"` // whether the assets are the token, as they were offered
+	WantToken   bool   `json:"wantToken,omitempty"`
+	Taker       string `json:"taker,omitempty"`   // the only entity that may accept, anyone when empty
+	Expires     int64  `json:"expires,omitempty"` // unix seconds, never when 0
+	OfferedBy   string `json:"offeredBy"`
+	Fee         int    `json:"fee,omitempty"` // charged on the token leg when accepted
+	AcceptedBy  string `json:"acceptedBy,omitempty"`
+	AcceptedFor string `json:"acceptedFor,omitempty"`
+}
+
+func (o *swapOffer) expired(now int64) bool {
+	return o.Expires != 0 && now >= o.Expires
+}
+
+// swapOffersOf lists the open offers sorted by id, of all entities when entity is empty or else
+// of those made by or to it
+func swapOffersOf(stub shim.ChaincodeStubInterface, entity string) ([]swapOffer, error) {
+	it, err := stub.GetStateByPartialCompositeKey(swapObjectType, []string{})
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+
+	offers := []swapOffer{}
+	for it.HasNext() {
+		kv, err := it.Next()
+		if err != nil {
+			return nil, err
+		}
+		var o swapOffer
+		if err = openJSON(stub, kv.Key, kv.Value, &o); err != nil {
+			return nil, err
+		}
+		if entity == "" || o.Maker == entity || o.Taker == entity {
+			offers = append(offers, o)
+		}
+	}
+
+	sort.SliceStable(offers, func(i, j int) bool {
+		return offers[i].ID < offers[j].ID
+	})
+	return offers, nil
+}
+
+// swapEscrowed sums the token units held by open offers
+func swapEscrowed(stub shim.ChaincodeStubInterface) (int, error) {
+	offers, err := swapOffersOf(stub, "")
+	if err != nil {
+		return 0, err
+	}
+	sum := 0
+	for _, o := range offers {
+		if o.GiveToken {
+			sum += o.GiveAmount
+		}
+	}
+	return sum, nil
+}
+
+// closeOffer removes the offer and sends it as the event of the transaction
+func closeOffer(stub shim.ChaincodeStubInterface, event string, o *swapOffer) pb.Response {
+	key, err := stub.CreateCompositeKey(swapObjectType, []string{o.ID})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err = stub.DelState(key); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	offerBytes, err := json.Marshal(o)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err = stub.SetEvent(event, offerBytes); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(offerBytes)
+}
+
+func getOffer(stub shim.ChaincodeStubInterface, offerID string) (*swapOffer, error) {
+	o := &swapOffer{}
+	found, err := getJSON(stub, swapObjectType, []string{offerID}, o)
+	if err != nil || !found {
+		return nil, err
+	}
+	return o, nil
+}
+
+// offers an amount of one asset of an entity of the caller for an amount of another:
+// maker, asset and amount given, asset and amount wanted, taker and expiry, the last two may be empty
+func (t *SimpleChaincode) offerSwap(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 7 {
+		return pb.Response{Status: 403, Message: "Incorrect number of arguments. Expecting maker, asset and amount given, asset and amount wanted, taker and expiry"}
+	}
+
+	o := &swapOffer{ID: stub.GetTxID(), Maker: args[0], GiveAsset: args[1], WantAsset: args[3], Taker: args[5]}
+	var err error
+	if o.GiveAmount, err = parseAmount(args[2]); err != nil {
+		return pb.Response{Status: 403, Message: err.Error()}
+	}
+	if o.WantAmount, err = parseAmount(args[4]); err != nil {
+		return pb.Response{Status: 403, Message: err.Error()}
+	}
+	if o.GiveAsset == "" || o.WantAsset == "" || o.GiveAsset == o.WantAsset {
+		return pb.Response{Status: 403, Message: "A swap exchanges two different assets"}
+	}
+	if o.Expires, err = parseExpiry(args[6]); err != nil {
+		return pb.Response{Status: 403, Message: err.Error()}
+	}
+
+	id, err := getCreator(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !id.owns(o.Maker) {
+		return pb.Response{Status: 403, Message: "Only the owner of " + o.Maker + " may offer its assets"}
+	}
+	o.OfferedBy = id.name()
+
+	// which asset is the token is settled now, a later change of the symbol leaves the offer as it is
+	if o.GiveToken, err = isToken(stub, o.GiveAsset); err != nil {
+		return shim.Error(err.Error())
+	}
+	if o.WantToken, err = isToken(stub, o.WantAsset); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	available, err := assetAvailable(stub, o.GiveAsset, o.Maker, o.GiveToken)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if available < o.GiveAmount {
+		return pb.Response{Status: 403, Message: fmt.Sprintf("Insufficient funds: %s has %d %s available", o.Maker, available, o.GiveAsset)}
+	}
+
+	if err = addAsset(stub, o.GiveAsset, o.Maker, -o.GiveAmount, o.GiveToken); err != nil {
+		return errorResponse(err)
+	}
+	if err = putJSON(stub, swapObjectType, []string{o.ID}, o); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	offerBytes, err := json.Marshal(o)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err = stub.SetEvent("offerSwap", offerBytes); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(offerBytes)
+}
+
+// swapLeg returns what the payee of a swap leg receives and adds its fee, and what its payer and
+// the org of the payer send, to those of the swap, only the token pays fees and counts against the
+// velocity limits
+func swapLeg(stub shim.ChaincodeStubInterface, token bool, from, org, to string, amount int, fees, sent, orgs map[string]int) (int, pb.Response) {
+	if !token {
+		return amount, shim.Success(nil)
+	}
+
+	e, err := itemise(stub, "acceptSwap", from, to, amount)
+	if err != nil {
+		return 0, shim.Error(err.Error())
+	}
+	if e.Net <= 0 {
+		return 0, pb.Response{Status: 403, Message: fmt.Sprintf("Amount %d does not cover the fee of %d", e.Value, e.Fee)}
+	}
+	fees[e.Collector] += e.Fee
+	sent[from] += amount
+	orgs[org] += amount
+	return e.Net, shim.Success(nil)
+}
+
+// executes both legs of an offer for an entity of the caller: offer id and taker
+func (t *SimpleChaincode) acceptSwap(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		return pb.Response{Status: 403, Message: "Incorrect number of arguments. Expecting offer id and taker"}
+	}
+
+	o, err := getOffer(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if o == nil {
+		return pb.Response{Status: 404, Message: "Offer not found"}
+	}
+	taker := args[1]
+	if o.Taker != "" && o.Taker != taker {
+		return pb.Response{Status: 403, Message: "Offer is reserved to " + o.Taker}
+	}
+	if taker == o.Maker {
+		return pb.Response{Status: 403, Message: "The maker cannot accept its own offer"}
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if o.expired(now) {
+		return pb.Response{Status: 403, Message: "Offer expired"}
+	}
+
+	id, err := getCreator(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !id.owns(taker) {
+		return pb.Response{Status: 403, Message: "Only the owner of " + taker + " may accept for it"}
+	}
+
+	available, err := assetAvailable(stub, o.WantAsset, taker, o.WantToken)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if available < o.WantAmount {
+		return pb.Response{Status: 403, Message: fmt.Sprintf("Insufficient funds: %s has %d %s available", taker, available, o.WantAsset)}
+	}
+
+	// the leg of the maker counts against the org that made the offer, not the one accepting it
+	fees, sent, orgs := map[string]int{}, map[string]int{}, map[string]int{}
+	wantNet, response := swapLeg(stub, o.WantToken, taker, id.Org, o.Maker, o.WantAmount, fees, sent, orgs)
+	if response.Status >= shim.ERRORTHRESHOLD {
+		return response
+	}
+	giveNet, response := swapLeg(stub, o.GiveToken, o.Maker, orgOf(o.OfferedBy), taker, o.GiveAmount, fees, sent, orgs)
+	if response.Status >= shim.ERRORTHRESHOLD {
+		return response
+	}
+	if response = spendVelocity(stub, sent, orgs); response.Status >= shim.ERRORTHRESHOLD {
+		return response
+	}
+
+	// both legs or none: the asked asset to the maker and the escrow to the taker
+	if err = addAsset(stub, o.WantAsset, taker, -o.WantAmount, o.WantToken); err != nil {
+		return errorResponse(err)
+	}
+	if err = addAsset(stub, o.WantAsset, o.Maker, wantNet, o.WantToken); err != nil {
+		return errorResponse(err)
+	}
+	if err = addAsset(stub, o.GiveAsset, taker, giveNet, o.GiveToken); err != nil {
+		return errorResponse(err)
+	}
+	if err = creditFees(stub, fees); err != nil {
+		return errorResponse(err)
+	}
+	for _, fee := range fees {
+		o.Fee += fee
+	}
+
+	o.AcceptedBy = id.name()
+	o.AcceptedFor = taker
+	return closeOffer(stub, "acceptSwap", o)
+}
+
+// withdraws an offer and returns its escrow to the maker, anyone may cancel expired offers: offer id
+func (t *SimpleChaincode) cancelSwap(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return pb.Response{Status: 403, Message: "Incorrect number of arguments. Expecting offer id"}
+	}
+
+	o, err := getOffer(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if o == nil {
+		return pb.Response{Status: 404, Message: "Offer not found"}
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !o.expired(now) {
+		id, err := getCreator(stub)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if !id.owns(o.Maker) {
+			return pb.Response{Status: 403, Message: "Only the owner of " + o.Maker + " may cancel the offer before it expires"}
+		}
+	}
+
+	if err = addAsset(stub, o.GiveAsset, o.Maker, o.GiveAmount, o.GiveToken); err != nil {
+		return errorResponse(err)
+	}
+
+	return closeOffer(stub, "cancelSwap", o)
+}
+
+// open offers by id: optional entity making them or reserved to it
+func (t *SimpleChaincode) swapOffers(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) > 1 {
+		return pb.Response{Status: 403, Message: "Incorrect number of arguments. Expecting optional entity"}
+	}
+
+	entity := ""
+	if len(args) == 1 {
+		entity = args[0]
+	}
+	offers, err := swapOffersOf(stub, entity)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	offersBytes, err := json.Marshal(offers)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(offersBytes)
+}
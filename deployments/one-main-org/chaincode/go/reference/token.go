@@ -0,0 +1,371 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// ERC-20 style token interface over the entity balances. The caller holds the tokens of its
+// personal account, CN@org or its certificate hash, and of the entity named after its org. Allowances
+// let a spender take up to a cap from an entity it does not own, until they expire; they live
+// under allowance~owner~spender.
+const allowanceObjectType = "allowance"
+
+// tokenInfo is kept under the "token" config key
+type tokenInfo struct {
+	Name     string `json:"name"`
+	Symbol   string `json:"symbol"`
+	Decimals int    `json:"decimals"`
+}
+
+var defaultTokenInfo = tokenInfo{Name: "Reference Token", Symbol: "REF", Decimals: 0}
+
+type allowanceRecord struct {
+	Amount  int   `json:"amount"`
+	Expires int64 `json:"expires,omitempty"` // unix seconds, never when 0
+}
+
+// active is the amount still spendable at unix time now
+func (a *allowanceRecord) active(now int64) int {
+	if a.Expires != 0 && now >= a.Expires {
+		return 0
+	}
+	return a.Amount
+}
+
+// transferEvent itemises a transfer: the payer sends value, the payee receives net and the fee collector the fee
+type transferEvent struct {
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Value     int    `json:"value"`
+	Fee       int    `json:"fee"`
+	Net       int    `json:"net"`
+	Collector string `json:"collector,omitempty"`
+}
+
+type approvalEvent struct {
+	Owner   string `json:"owner"`
+	Spender string `json:"spender"`
+	Value   int    `json:"value"`
+}
+
+func getTokenInfo(stub shim.ChaincodeStubInterface) (tokenInfo, error) {
+	info := defaultTokenInfo
+	_, err := configJSON(stub, "token", &info)
+	return info, err
+}
+
+// checkTokenInfo fills what the token info leaves out with the defaults
+func checkTokenInfo(stub shim.ChaincodeStubInterface, name, value string) (string, error) {
+	info := defaultTokenInfo
+	if err := json.Unmarshal([]byte(value), &info); err != nil {
+		return "", fmt.Errorf("invalid token info: %s", err)
+	}
+	if info.Decimals < 0 || info.Decimals > 18 {
+		return "", fmt.Errorf("decimals must be between 0 and 18")
+	}
+	issued, err := assetIssued(stub, info.Symbol)
+	if err != nil {
+		return "", err
+	}
+	if issued {
+		return "", fmt.Errorf("symbol %s is the name of an asset", info.Symbol)
+	}
+	infoBytes, err := json.Marshal(info)
+	return string(infoBytes), err
+}
+
+func getAllowance(stub shim.ChaincodeStubInterface, owner, spender string) (*allowanceRecord, error) {
+	a := &allowanceRecord{}
+	_, err := getJSON(stub, allowanceObjectType, []string{owner, spender}, a)
+	return a, err
+}
+
+// owns tells whether the identity may spend from the entity without an allowance: its personal
+// accounts, and the entity of its org when it is an admin there
+func (id *identity) owns(entity string) bool {
+	return entity == id.name() || entity == id.certHash() || (entity == id.Org && id.hasRole("admin"))
+}
+
+func txTime(stub shim.ChaincodeStubInterface) (int64, error) {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return 0, err
+	}
+	return ts.Seconds, nil
+}
+
+// spendAllowance takes x units off the active allowance of the spender on the owner entity
+func spendAllowance(stub shim.ChaincodeStubInterface, owner, spender string, x int) pb.Response {
+	a, err := getAllowance(stub, owner, spender)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if a.active(now) < x {
+		return pb.Response{Status: 403, Message: fmt.Sprintf("Allowance exceeded: %s may transfer %d from %s", spender, a.active(now), owner)}
+	}
+
+	a.Amount -= x
+	err = putJSON(stub, allowanceObjectType, []string{owner, spender}, a)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// parseExpiry accepts unix seconds or an RFC 3339 time, empty for no expiry
+func parseExpiry(expiry string) (int64, error) {
+	if expiry == "" {
+		return 0, nil
+	}
+	if seconds, err := strconv.ParseInt(expiry, 10, 64); err == nil {
+		return seconds, nil
+	}
+	t, err := time.Parse(time.RFC3339, expiry)
+	if err != nil {
+		return 0, fmt.Errorf("invalid expiry %s, expecting unix seconds or RFC 3339 time", expiry)
+	}
+	return t.Unix(), nil
+}
+
+func setEvent(stub shim.ChaincodeStubInterface, name string, event interface{}) error {
+	eventBytes, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return stub.SetEvent(name, eventBytes)
+}
+
+// moveUnits moves x units between entities less the fee of the function, the payer must have
+// them available, the payee is created when missing
+func moveUnits(stub shim.ChaincodeStubInterface, function, from, to string, x int) pb.Response {
+	available, found, err := availableBalance(stub, from, "")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !found {
+		return pb.Response{Status: 404, Message: "Entity not found"}
+	}
+	if available < x {
+		return pb.Response{Status: 403, Message: fmt.Sprintf("Insufficient funds: %s has %d available", from, available)}
+	}
+
+	e, err := itemise(stub, function, from, to, x)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return applyTransfer(stub, e)
+}
+
+// shiftUnits moves x units between entities less the fee of the function without looking at the
+// funds of the payer, the caller checked them
+func shiftUnits(stub shim.ChaincodeStubInterface, function, from, to string, x int) pb.Response {
+	e, err := itemise(stub, function, from, to, x)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return applyTransfer(stub, e)
+}
+
+func (t *SimpleChaincode) name(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	info, err := getTokenInfo(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success([]byte(info.Name))
+}
+
+func (t *SimpleChaincode) symbol(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	info, err := getTokenInfo(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success([]byte(info.Symbol))
+}
+
+func (t *SimpleChaincode) decimals(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	info, err := getTokenInfo(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success([]byte(strconv.Itoa(info.Decimals)))
+}
+
+// sets name, symbol and decimals of the token given as json
+func (t *SimpleChaincode) setTokenInfo(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return pb.Response{Status: 403, Message: "Incorrect number of arguments. Expecting token info as json"}
+	}
+
+	return changeConfig(stub, "token", args[0])
+}
+
+// balance of an owner, 0 for owners without an entity
+func (t *SimpleChaincode) balanceOf(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return pb.Response{Status: 403, Message: "Incorrect number of arguments. Expecting owner"}
+	}
+
+	balance, _, err := getBalance(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success([]byte(strconv.Itoa(balance)))
+}
+
+// transfers x units from the caller to an owner
+func (t *SimpleChaincode) transfer(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		return pb.Response{Status: 403, Message: "Incorrect number of arguments. Expecting recipient and amount"}
+	}
+
+	x, err := parseAmount(args[1])
+	if err != nil {
+		return pb.Response{Status: 403, Message: err.Error()}
+	}
+
+	account, err := myAccount(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return moveUnits(stub, "transfer", account, args[0], x)
+}
+
+// lets a spender transfer up to x units from the caller, replacing any previous allowance:
+// spender, amount, optional expiry and optional entity of the caller, its personal account by default
+func (t *SimpleChaincode) approve(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 2 || len(args) > 4 {
+		return pb.Response{Status: 403, Message: "Incorrect number of arguments. Expecting spender, amount, optional expiry and entity"}
+	}
+
+	x, err := strconv.Atoi(args[1])
+	if err != nil || x < 0 {
+		return pb.Response{Status: 403, Message: "Invalid amount, expecting a non negative integer"}
+	}
+
+	var expires int64
+	if len(args) > 2 {
+		if expires, err = parseExpiry(args[2]); err != nil {
+			return pb.Response{Status: 403, Message: err.Error()}
+		}
+	}
+
+	id, err := getCreator(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	owner, err := myAccount(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	spender := args[0]
+	if len(args) > 3 && args[3] != "" {
+		owner = args[3]
+	}
+	if !id.owns(owner) {
+		return pb.Response{Status: 403, Message: "Only the owner of " + owner + " may approve spending from it"}
+	}
+
+	err = putJSON(stub, allowanceObjectType, []string{owner, spender}, allowanceRecord{Amount: x, Expires: expires})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if err = setEvent(stub, "Approval", approvalEvent{owner, spender, x}); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// withdraws the allowance of a spender: spender and optional entity of the caller, its personal account by default
+func (t *SimpleChaincode) revokeApproval(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 1 || len(args) > 2 {
+		return pb.Response{Status: 403, Message: "Incorrect number of arguments. Expecting spender and optional entity"}
+	}
+
+	id, err := getCreator(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	owner, err := myAccount(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	spender := args[0]
+	if len(args) > 1 && args[1] != "" {
+		owner = args[1]
+	}
+	if !id.owns(owner) {
+		return pb.Response{Status: 403, Message: "Only the owner of " + owner + " may revoke approvals on it"}
+	}
+
+	key, err := stub.CreateCompositeKey(allowanceObjectType, []string{owner, spender})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err = stub.DelState(key); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	if err = setEvent(stub, "Approval", approvalEvent{owner, spender, 0}); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// units a spender may still transfer from an owner, 0 once the allowance expired
+func (t *SimpleChaincode) allowance(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		return pb.Response{Status: 403, Message: "Incorrect number of arguments. Expecting owner and spender"}
+	}
+
+	a, err := getAllowance(stub, args[0], args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success([]byte(strconv.Itoa(a.active(now))))
+}
+
+// transfers x units from an owner to a recipient within the allowance the owner gave the caller
+func (t *SimpleChaincode) transferFrom(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return pb.Response{Status: 403, Message: "Incorrect number of arguments. Expecting owner, recipient and amount"}
+	}
+
+	from, to := args[0], args[1]
+	x, err := parseAmount(args[2])
+	if err != nil {
+		return pb.Response{Status: 403, Message: err.Error()}
+	}
+
+	id, err := getCreator(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if response := spendAllowance(stub, from, id.name(), x); response.Status >= shim.ERRORTHRESHOLD {
+		return response
+	}
+
+	return moveUnits(stub, "transferFrom", from, to, x)
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Velocity limits cap what an account, or the identities of an org together, send per UTC day and
+// over a rolling window of days. They are json settings under limit:account:<entity> and
+// limit:org:<org>, with limit:account and limit:org applying to those without their own. Outgoing
+// totals are kept per UTC day of the transaction time under velocity~kind~subject~day, only while
+// a limit applies, so a limit counts what was sent from the time it is set. Transfers exceeding a
+// limit fail with status 429.
+const (
+	limitConfigPrefix     = "limit:"
+	velocityObjectType    = "velocity"
+	velocityAccount       = "account"
+	velocityOrg           = "org"
+	statusLimitExceeded   = 429
+	maxVelocityWindowDays = 366
+)
+
+type velocityLimit struct {
+	Daily  int `json:"daily,omitempty"`  // most sent per UTC day, no limit when 0
+	Window int `json:"window,omitempty"` // most sent over the window, no limit when 0
+	Days   int `json:"days,omitempty"`   // UTC days of the window, today included
+}
+
+func (l *velocityLimit) validate() error {
+	if l.Daily < 0 || l.Window < 0 || l.Days < 0 {
+		return fmt.Errorf("daily, window and days must not be negative")
+	}
+	if l.Window > 0 && (l.Days < 1 || l.Days > maxVelocityWindowDays) {
+		return fmt.Errorf("a window needs between 1 and %d days", maxVelocityWindowDays)
+	}
+	return nil
+}
+
+func checkVelocityLimit(stub shim.ChaincodeStubInterface, name, value string) (string, error) {
+	kind := strings.SplitN(strings.TrimPrefix(name, limitConfigPrefix), ":", 2)[0]
+	if kind != velocityAccount && kind != velocityOrg {
+		return "", fmt.Errorf("limits apply to an account or an org, not %s", kind)
+	}
+	l := &velocityLimit{}
+	if err := json.Unmarshal([]byte(value), l); err != nil {
+		return "", fmt.Errorf("invalid limit: %s", err)
+	}
+	if err := l.validate(); err != nil {
+		return "", err
+	}
+	limitBytes, err := json.Marshal(l)
+	return string(limitBytes), err
+}
+
+// getVelocityLimit returns the limit of an account or org, nil when none applies
+func getVelocityLimit(stub shim.ChaincodeStubInterface, kind, subject string) (*velocityLimit, error) {
+	l := &velocityLimit{}
+	found, err := configJSON(stub, limitConfigPrefix+kind+":"+subject, l)
+	if err == nil && !found {
+		found, err = configJSON(stub, limitConfigPrefix+kind, l)
+	}
+	if err != nil || !found {
+		return nil, err
+	}
+	return l, nil
+}
+
+// velocityDay is the UTC day bucket of unix time now, days before it
+func velocityDay(now int64, before int) string {
+	return time.Unix(now, 0).UTC().AddDate(0, 0, -before).Format("2006-01-02")
+}
+
+func velocitySent(stub shim.ChaincodeStubInterface, kind, subject, day string) (int, error) {
+	key, err := stub.CreateCompositeKey(velocityObjectType, []string{kind, subject, day})
+	if err != nil {
+		return 0, err
+	}
+	sent, _, err := readAmount(stub, key)
+	return sent, err
+}
+
+// velocityUsage is what an account or org sent and may still send under its limit
+type velocityUsage struct {
+	Kind            string         `json:"kind"`
+	Subject         string         `json:"subject"`
+	Limit           *velocityLimit `json:"limit,omitempty"`
+	SentToday       int            `json:"sentToday"`
+	SentInWindow    int            `json:"sentInWindow"`
+	RemainingToday  *int           `json:"remainingToday,omitempty"`  // absent without a daily limit
+	RemainingWindow *int           `json:"remainingWindow,omitempty"` // absent without a window limit
+}
+
+func getVelocityUsage(stub shim.ChaincodeStubInterface, kind, subject string, now int64) (*velocityUsage, error) {
+	l, err := getVelocityLimit(stub, kind, subject)
+	if err != nil {
+		return nil, err
+	}
+	u := &velocityUsage{Kind: kind, Subject: subject, Limit: l}
+	if l == nil {
+		return u, nil
+	}
+
+	days := l.Days
+	if days < 1 {
+		days = 1
+	}
+	for i := 0; i < days; i++ {
+		sent, err := velocitySent(stub, kind, subject, velocityDay(now, i))
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			u.SentToday = sent
+		}
+		u.SentInWindow += sent
+	}
+
+	remaining := func(limit, sent int) *int {
+		r := limit - sent
+		if r < 0 {
+			r = 0
+		}
+		return &r
+	}
+	if l.Daily > 0 {
+		u.RemainingToday = remaining(l.Daily, u.SentToday)
+	}
+	if l.Window > 0 {
+		u.RemainingWindow = remaining(l.Window, u.SentInWindow)
+	}
+	return u, nil
+}
+
+// checkVelocity checks the amounts sent by the entities of a transaction, and by the orgs they are
+// charged to, against their limits and returns the totals of the day they come to by key. With
+// orgs nil everything sent is charged to the org of the caller.
+func checkVelocity(stub shim.ChaincodeStubInterface, sent, orgs map[string]int) (map[string]int, pb.Response) {
+	now, err := txTime(stub)
+	if err != nil {
+		return nil, shim.Error(err.Error())
+	}
+	if orgs == nil {
+		id, err := getCreator(stub)
+		if err != nil {
+			return nil, shim.Error(err.Error())
+		}
+		orgs = map[string]int{}
+		for _, amount := range sent {
+			if amount > 0 {
+				orgs[id.Org] += amount
+			}
+		}
+	}
+
+	amounts := map[[2]string]int{}
+	for entity, amount := range sent {
+		if amount > 0 {
+			amounts[[2]string{velocityAccount, entity}] += amount
+		}
+	}
+	for org, amount := range orgs {
+		if amount > 0 {
+			amounts[[2]string{velocityOrg, org}] += amount
+		}
+	}
+	// in a fixed order, so that every peer fails on the same limit
+	subjects := make([][2]string, 0, len(amounts))
+	for subject := range amounts {
+		subjects = append(subjects, subject)
+	}
+	sort.Slice(subjects, func(i, j int) bool {
+		return subjects[i][0]+"~"+subjects[i][1] < subjects[j][0]+"~"+subjects[j][1]
+	})
+
+	totals := map[string]int{}
+	for _, subject := range subjects {
+		kind, name, amount := subject[0], subject[1], amounts[subject]
+		u, err := getVelocityUsage(stub, kind, name, now)
+		if err != nil {
+			return nil, shim.Error(err.Error())
+		}
+		if u.Limit == nil {
+			continue
+		}
+		if u.RemainingToday != nil && amount > *u.RemainingToday {
+			return nil, pb.Response{Status: statusLimitExceeded, Message: fmt.Sprintf("Daily limit of %s %s exceeded: %d of %d sent today", kind, name, u.SentToday, u.Limit.Daily)}
+		}
+		if u.RemainingWindow != nil && amount > *u.RemainingWindow {
+			return nil, pb.Response{Status: statusLimitExceeded, Message: fmt.Sprintf("Limit of %s %s over %d days exceeded: %d of %d sent", kind, name, u.Limit.Days, u.SentInWindow, u.Limit.Window)}
+		}
+
+		key, err := stub.CreateCompositeKey(velocityObjectType, []string{kind, name, velocityDay(now, 0)})
+		if err != nil {
+			return nil, shim.Error(err.Error())
+		}
+		totals[key] = u.SentToday + amount
+	}
+
+	return totals, shim.Success(nil)
+}
+
+// spendVelocity checks the amounts sent by the entities of a transaction against their limits
+// and adds them to the totals of the day. It is called once per transaction with everything the
+// transaction sends, the totals are read from the committed state.
+func spendVelocity(stub shim.ChaincodeStubInterface, sent, orgs map[string]int) pb.Response {
+	totals, response := checkVelocity(stub, sent, orgs)
+	if response.Status >= shim.ERRORTHRESHOLD {
+		return response
+	}
+	for key, total := range totals {
+		if err := writeAmount(stub, key, total); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	return shim.Success(nil)
+}
+
+// what an account and the org of the caller sent today and over their window and what they may
+// still send: optional account, the personal account of the caller by default
+func (t *SimpleChaincode) limits(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) > 1 {
+		return pb.Response{Status: 403, Message: "Incorrect number of arguments. Expecting optional account"}
+	}
+
+	id, err := getCreator(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	account := ""
+	if len(args) == 1 {
+		account = args[0]
+	}
+	if account == "" {
+		if account, err = myAccount(stub); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	usage := []*velocityUsage{}
+	for _, subject := range [][2]string{{velocityAccount, account}, {velocityOrg, id.Org}} {
+		u, err := getVelocityUsage(stub, subject[0], subject[1], now)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		usage = append(usage, u)
+	}
+
+	usageBytes, err := json.Marshal(usage)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(usageBytes)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// TestExecuteDueChargesSchedulerOrg checks that a release counts against the limit of the org that
+// scheduled it, not of the org executing it
+func TestExecuteDueChargesSchedulerOrg(t *testing.T) {
+	l := newMockLedger()
+	l.seedBalances(map[string]int{"user0@a": 100, "payee": 0})
+	l.setConfig(limitConfigPrefix+velocityOrg+":a", `{"daily":50}`)
+	payer := testCreator(t, "user0", "a")
+	keeper := testCreator(t, "keeper", "b")
+	cc := new(SimpleChaincode)
+
+	for _, txID := range []string{"s1", "s2"} {
+		tx := l.tx(txID, payer, "scheduleMove", "user0@a", "payee", "30", "1700000100")
+		if response := tx.invoke(cc); response.Status != 200 {
+			t.Fatalf("scheduleMove: status %d %s", response.Status, response.Message)
+		}
+		l.commit([]*mockTx{tx})
+	}
+	l.time = 1700000200
+
+	tx := l.tx("execute", keeper, "executeDue")
+	response := tx.invoke(cc)
+	if response.Status != 200 {
+		t.Fatalf("executeDue: status %d %s", response.Status, response.Message)
+	}
+	l.commit([]*mockTx{tx})
+
+	var executed []schedule
+	if err := json.Unmarshal(response.Payload, &executed); err != nil {
+		t.Fatal(err)
+	}
+	if len(executed) != 1 {
+		t.Fatalf("executeDue by another org released %d schedules, the daily limit of a allows 1", len(executed))
+	}
+	query := l.tx("query", keeper, "query", "payee")
+	if balance := string(query.invoke(cc).Payload); balance != "30" {
+		t.Errorf("balance of the payee: %s, expected 30", balance)
+	}
+	for org, expected := range map[string]string{"a": "30", "b": ""} {
+		key, _ := tx.CreateCompositeKey(velocityObjectType, []string{velocityOrg, org, velocityDay(l.time, 0)})
+		if sent := string(l.state[key].value); sent != expected {
+			t.Errorf("sent today by org %s: %q, expected %q", org, sent, expected)
+		}
+	}
+}
@@ -6,9 +6,10 @@ import (
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	pb "github.com/hyperledger/fabric/protos/peer"
-	"encoding/pem"
-	"crypto/x509"
-	"strings"
+	"encoding/json"
+	"time"
+
+	"observability"
 )
 
 var logger = shim.NewLogger("SimpleChaincode")
@@ -18,9 +19,10 @@ type SimpleChaincode struct {
 }
 
 func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
-	logger.Debug("Init")
+	function, args := stub.GetFunctionAndParameters()
+	log := newTxLogger(stub, function)
+	log.Debugf("Init %v", log.RedactArgs(args))
 
-	_, args := stub.GetFunctionAndParameters()
 	var a, b string    // Entities
 	var aVal, bVal int // Asset holdings
 	var err error
@@ -40,7 +42,7 @@ func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
 	if err != nil {
 		return pb.Response{Status:403, Message:"Expecting integer value for asset holding"}
 	}
-	logger.Debugf("aVal, bVal = %d", aVal, bVal)
+	log.Debugf("aVal = %d, bVal = %d", aVal, bVal)
 
 	// Write the state to the ledger
 	err = stub.PutState(a, []byte(strconv.Itoa(aVal)))
@@ -53,34 +55,96 @@ func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
 		return shim.Error(err.Error())
 	}
 
-	return shim.Success(nil)
-}
-
-func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
-	logger.Debug("Invoke")
-
-	creatorBytes, err := stub.GetCreator()
+	// The two entities are the parties of the channel
+	partiesBytes, err := json.Marshal([]string{a, b})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = putConfig(stub, "parties", partiesBytes)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 
-	name, org := getCreator(creatorBytes)
+	return shim.Success(nil)
+}
 
-	logger.Debug("transaction creator " + name + "@" + org)
+// function is a chaincode function callable through Invoke
+type function struct {
+	handler func(t *SimpleChaincode, stub shim.ChaincodeStubInterface, args []string) pb.Response
+	role    string // role the caller must hold, anyone may call the function if empty
+}
 
-	function, args := stub.GetFunctionAndParameters()
-	if function == "move" {
+// functions is the access policy of the chaincode: every invocable function and who may call it
+var functions map[string]function
+
+func init() {
+	functions = map[string]function{
 		// Make payment of x units from a to b
-		return t.move(stub, args)
-	} else if function == "delete" {
+		"move": {handler: (*SimpleChaincode).move},
 		// Deletes an entity from its state
-		return t.delete(stub, args)
-	} else if function == "query" {
+		"delete": {handler: (*SimpleChaincode).delete},
 		// the old "Query" is now implemented in invoke
-		return t.query(stub, args)
+		"query": {handler: (*SimpleChaincode).query},
+		// Hash time-locked contracts, settling payments routed over several channels on all or none
+		"lock": {handler: (*SimpleChaincode).lock},
+		"claim": {handler: (*SimpleChaincode).claim},
+		"refund": {handler: (*SimpleChaincode).refund},
+		"getHTLC": {handler: (*SimpleChaincode).getHTLC},
+		// Credit lines agreed by both counterparties, letting balances go below zero
+		"setCreditLimit": {handler: (*SimpleChaincode).setCreditLimit},
+		"acceptCreditLimit": {handler: (*SimpleChaincode).acceptCreditLimit},
+		"position": {handler: (*SimpleChaincode).position},
+		// Netting cycles settling the moves of a period at once
+		"openCycle": {handler: (*SimpleChaincode).openCycle},
+		"closeCycle": {handler: (*SimpleChaincode).closeCycle},
+		"confirmCycle": {handler: (*SimpleChaincode).confirmCycle},
+		"statement": {handler: (*SimpleChaincode).statement},
+		// Describes the transaction creator as the chaincode sees it
+		"whoami": {handler: (*SimpleChaincode).whoami},
+		// Sets level, format and argument redaction of the chaincode log
+		"setLogging": {handler: (*SimpleChaincode).setLogging, role: "admin"},
 	}
+}
 
-	return pb.Response{Status:403, Message:"Invalid invoke function name."}
+func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+	function, args := stub.GetFunctionAndParameters()
+	log := newTxLogger(stub, function)
+
+	response := t.invoke(&txStub{stub, log}, function, args)
+	if response.Status >= shim.ERRORTHRESHOLD {
+		log.Infof("failed with status %d: %s", response.Status, response.Message)
+	} else {
+		log.Debugf("completed with status %d", response.Status)
+	}
+
+	// keep unknown names out of the metric labels
+	if _, ok := functions[function]; !ok {
+		function = "unknown"
+	}
+	metrics.ObserveInvoke(function, response.Status, time.Since(log.Start))
+
+	return response
+}
+
+// invoke checks the caller may call the function and calls it
+func (t *SimpleChaincode) invoke(stub *txStub, function string, args []string) pb.Response {
+	id, err := getCreator(stub)
+	if err != nil {
+		return pb.Response{Status:403, Message:err.Error()}
+	}
+	stub.log.Caller = id.CommonName + "@" + id.Org
+
+	stub.log.Debugf("Invoke %v", stub.log.RedactArgs(args))
+
+	f, ok := functions[function]
+	if !ok {
+		return pb.Response{Status:403, Message:"Invalid invoke function name."}
+	}
+	if !id.canInvoke(function) {
+		return pb.Response{Status:403, Message:"Function " + function + " requires role " + f.role}
+	}
+
+	return f.handler(t, stub, args)
 }
 
 // Transaction makes payment of x units from a to b
@@ -97,6 +161,15 @@ func (t *SimpleChaincode) move(stub shim.ChaincodeStubInterface, args []string)
 	a = args[0]
 	b = args[1]
 
+	// Only the owner of a pays from it, in a netting cycle as well
+	id, err := getCreator(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !id.owns(a) {
+		return pb.Response{Status:403, Message:"Only the owner of " + a + " may move from it"}
+	}
+
 	// Get the state from the ledger
 	aBytes, err := stub.GetState(a)
 	if err != nil {
@@ -121,9 +194,46 @@ func (t *SimpleChaincode) move(stub shim.ChaincodeStubInterface, args []string)
 	if err != nil {
 		return pb.Response{Status:403, Message:"Invalid transaction amount, expecting a integer value"}
 	}
+	if x <= 0 {
+		return pb.Response{Status:403, Message:"Invalid transaction amount, expecting a positive integer"}
+	}
+
+	// a may go below zero down to the credit its counterparties granted it, less what it owes in
+	// netting cycles not settled yet
+	_, available, _, err := spendable(stub, a)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Moves of an open netting cycle settle when the cycle does, what a receives in it offsets them
+	c, err := currentCycle(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if c != nil {
+		moves, err := cycleMoves(stub, c.ID)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if received := netPositions(moves)[a]; received > 0 {
+			available += received
+		}
+	}
+
+	if available < x {
+		return pb.Response{Status:403, Message:"Insufficient funds: " + a + " can pay " + strconv.Itoa(available) + " within its credit limits"}
+	}
+
+	if c != nil {
+		err = recordCycleMove(stub, c, a, b, x)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		return shim.Success(nil)
+	}
 	aVal = aVal - x
 	bVal = bVal + x
-	logger.Debug("aVal = %d, bVal = %d\n", aVal, bVal)
+	txLog(stub).Debugf("aVal = %d, bVal = %d", aVal, bVal)
 
 	// Write the state back to the ledger
 	err = stub.PutState(a, []byte(strconv.Itoa(aVal)))
@@ -180,20 +290,68 @@ func (t *SimpleChaincode) query(stub shim.ChaincodeStubInterface, args []string)
 	return shim.Success(valBytes)
 }
 
-var getCreator = func (certificate []byte) (string, string) {
-	data := certificate[strings.Index(string(certificate), "-----"): strings.LastIndex(string(certificate), "-----")+5]
-	block, _ := pem.Decode([]byte(data))
-	cert, _ := x509.ParseCertificate(block.Bytes)
-	organization := cert.Issuer.Organization[0]
-	commonName := cert.Subject.CommonName
-	logger.Debug("commonName: " + commonName + ", organization: " + organization)
+// getCreator resolves the identity of the transaction creator
+var getCreator = func (stub shim.ChaincodeStubInterface) (*identity, error) {
+	creatorBytes, err := stub.GetCreator()
+	if err != nil {
+		return nil, err
+	}
+	return parseCreator(creatorBytes)
+}
+
+// describes the transaction creator: identity, certificate, roles and permitted functions
+func (t *SimpleChaincode) whoami(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	id, err := getCreator(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
-	organizationShort := strings.Split(organization, ".")[0]
+	whoami := struct {
+		*identity
+		Roles       []string `json:"roles"`
+		Permissions []string `json:"permissions"`
+	}{id, id.roles(), id.permissions()}
 
-	return commonName, organizationShort
+	whoamiBytes, err := json.Marshal(whoami)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(whoamiBytes)
+}
+
+// stores the logging settings applied from the next transaction on
+func (t *SimpleChaincode) setLogging(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return pb.Response{Status:403, Message:"Incorrect number of arguments. Expecting logging config as json"}
+	}
+
+	c := &observability.LogConfig{}
+	if err := json.Unmarshal([]byte(args[0]), c); err != nil {
+		return pb.Response{Status:403, Message:"Invalid logging config: " + err.Error()}
+	}
+	if err := c.Validate(); err != nil {
+		return pb.Response{Status:403, Message:err.Error()}
+	}
+
+	configBytes, err := json.Marshal(c)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = putConfig(stub, "logging", configBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
 }
 
 func main() {
+	// lines are filtered per transaction by observability.TxLogger
+	logger.SetLevel(shim.LogDebug)
+
+	metrics.Serve(logger)
+
 	err := shim.Start(new(SimpleChaincode))
 	if err != nil {
 		logger.Error(err.Error())
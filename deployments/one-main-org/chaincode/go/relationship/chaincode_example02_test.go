@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+func TestMoveRequiresOwner(t *testing.T) {
+	defer func(previous func(shim.ChaincodeStubInterface) (*identity, error)) { getCreator = previous }(getCreator)
+	creator := &identity{CommonName: "Admin", Org: "a"}
+	getCreator = func(stub shim.ChaincodeStubInterface) (*identity, error) {
+		return creator, nil
+	}
+
+	stub := shim.NewMockStub("relationship", new(SimpleChaincode))
+	if response := stub.MockInit("init", [][]byte{[]byte("init"), []byte("a"), []byte("100"), []byte("b"), []byte("100")}); response.Status != shim.OK {
+		t.Fatalf("init: status %d %s", response.Status, response.Message)
+	}
+
+	// b may not pay out of a, neither directly nor within its credit limit
+	creator = &identity{CommonName: "Admin", Org: "b"}
+	response := stub.MockInvoke("tx1", [][]byte{[]byte("move"), []byte("a"), []byte("b"), []byte("10")})
+	if response.Status != 403 {
+		t.Errorf("move by a non-owner: status %d %s, expected 403", response.Status, response.Message)
+	}
+	if balance := string(stub.State["a"]); balance != "100" {
+		t.Errorf("balance of a after a refused move: %s", balance)
+	}
+
+	creator = &identity{CommonName: "Admin", Org: "a"}
+	response = stub.MockInvoke("tx2", [][]byte{[]byte("move"), []byte("a"), []byte("b"), []byte("10")})
+	if response.Status != shim.OK || string(stub.State["a"]) != "90" {
+		t.Errorf("move by the owner: status %d %s, a = %s", response.Status, response.Message, stub.State["a"])
+	}
+}
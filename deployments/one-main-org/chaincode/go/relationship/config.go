@@ -0,0 +1,24 @@
+package main
+
+import (
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// settings live under composite keys so they never clash with entity names
+const configObjectType = "config"
+
+func getConfig(stub shim.ChaincodeStubInterface, name string) ([]byte, error) {
+	key, err := stub.CreateCompositeKey(configObjectType, []string{name})
+	if err != nil {
+		return nil, err
+	}
+	return stub.GetState(key)
+}
+
+func putConfig(stub shim.ChaincodeStubInterface, name string, value []byte) error {
+	key, err := stub.CreateCompositeKey(configObjectType, []string{name})
+	if err != nil {
+		return err
+	}
+	return stub.PutState(key, value)
+}
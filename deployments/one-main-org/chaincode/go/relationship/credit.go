@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Counterparties on a relationship channel extend credit to each other: the balance of a debtor
+// may go below zero down to the sum of the credit lines its creditors granted it. A credit line
+// is proposed by one party and takes effect once the other party accepts it, proposals live under
+// creditProposal~debtor~creditor and agreed lines under credit~debtor~creditor.
+const (
+	creditObjectType         = "credit"
+	creditProposalObjectType = "creditProposal"
+)
+
+type creditLine struct {
+	Debtor     string `json:"debtor"`
+	Creditor   string `json:"creditor"`
+	Limit      int    `json:"limit"`
+	ProposedBy string `json:"proposedBy"`
+	AcceptedBy string `json:"acceptedBy,omitempty"`
+}
+
+// creditLines lists the agreed credit lines granted to a debtor
+func creditLines(stub shim.ChaincodeStubInterface, debtor string) ([]creditLine, error) {
+	it, err := stub.GetStateByPartialCompositeKey(creditObjectType, []string{debtor})
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+
+	lines := []creditLine{}
+	for it.HasNext() {
+		kv, err := it.Next()
+		if err != nil {
+			return nil, err
+		}
+		var line creditLine
+		if err = json.Unmarshal(kv.Value, &line); err != nil {
+			return nil, err
+		}
+		lines = append(lines, line)
+	}
+
+	return lines, nil
+}
+
+// spendable is how much an entity may pay: its balance plus the credit granted to it, less what it
+// owes in netting cycles not settled yet, found is false when the entity does not exist
+func spendable(stub shim.ChaincodeStubInterface, entity string) (balance int, available int, found bool, err error) {
+	balance, found, err = getBalance(stub, entity)
+	if err != nil || !found {
+		return 0, 0, found, err
+	}
+	lines, err := creditLines(stub, entity)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	owed, err := owedInCycles(stub, entity)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	available = balance - owed
+	for _, line := range lines {
+		available += line.Limit
+	}
+	return balance, available, true, nil
+}
+
+// proposes the credit a creditor grants a debtor, the caller owning either of them: debtor, creditor and limit
+func (t *SimpleChaincode) setCreditLimit(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return pb.Response{Status: 403, Message: "Incorrect number of arguments. Expecting debtor, creditor and limit"}
+	}
+
+	line := &creditLine{Debtor: args[0], Creditor: args[1]}
+	limit, err := strconv.Atoi(args[2])
+	if err != nil || limit < 0 {
+		return pb.Response{Status: 403, Message: "Invalid limit, expecting a non negative integer"}
+	}
+	line.Limit = limit
+	if line.Debtor == line.Creditor {
+		return pb.Response{Status: 403, Message: "Debtor and creditor must differ"}
+	}
+
+	id, err := getCreator(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	switch {
+	case id.owns(line.Debtor):
+		line.ProposedBy = line.Debtor
+	case id.owns(line.Creditor):
+		line.ProposedBy = line.Creditor
+	default:
+		return pb.Response{Status: 403, Message: "Only the debtor or the creditor may propose a credit limit"}
+	}
+
+	for _, entity := range []string{line.Debtor, line.Creditor} {
+		if _, found, err := getBalance(stub, entity); err != nil {
+			return shim.Error(err.Error())
+		} else if !found {
+			return pb.Response{Status: 404, Message: "Entity not found"}
+		}
+	}
+
+	if err = putJSON(stub, creditProposalObjectType, []string{line.Debtor, line.Creditor}, line); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	lineBytes, err := json.Marshal(line)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err = stub.SetEvent("proposeCreditLimit", lineBytes); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(lineBytes)
+}
+
+// agrees to the credit limit the other party proposed, the limit being the one agreed to so that
+// a proposal replaced in the meantime is not accepted unseen: debtor, creditor and limit
+func (t *SimpleChaincode) acceptCreditLimit(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return pb.Response{Status: 403, Message: "Incorrect number of arguments. Expecting debtor, creditor and limit"}
+	}
+	limit, err := strconv.Atoi(args[2])
+	if err != nil || limit < 0 {
+		return pb.Response{Status: 403, Message: "Invalid limit, expecting a non negative integer"}
+	}
+
+	line := &creditLine{}
+	found, err := getJSON(stub, creditProposalObjectType, []string{args[0], args[1]}, line)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !found {
+		return pb.Response{Status: 404, Message: "No credit limit proposed"}
+	}
+
+	counterparty := line.Debtor
+	if line.ProposedBy == line.Debtor {
+		counterparty = line.Creditor
+	}
+	id, err := getCreator(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !id.owns(counterparty) {
+		return pb.Response{Status: 403, Message: "Only " + counterparty + " may accept the credit limit proposed by " + line.ProposedBy}
+	}
+	if line.Limit != limit {
+		return pb.Response{Status: 409, Message: "The limit proposed by " + line.ProposedBy + " is " + strconv.Itoa(line.Limit) + ", not " + args[2]}
+	}
+
+	// lowering a limit below what is already used is allowed, the debtor just cannot pay until it is back within it
+	line.AcceptedBy = counterparty
+	if err = putJSON(stub, creditObjectType, []string{line.Debtor, line.Creditor}, line); err != nil {
+		return shim.Error(err.Error())
+	}
+	key, err := stub.CreateCompositeKey(creditProposalObjectType, []string{line.Debtor, line.Creditor})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err = stub.DelState(key); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	lineBytes, err := json.Marshal(line)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err = stub.SetEvent("creditLimit", lineBytes); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(lineBytes)
+}
+
+// balance of an entity with the utilisation and headroom of each credit line granted to it: entity
+func (t *SimpleChaincode) position(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return pb.Response{Status: 403, Message: "Incorrect number of arguments. Expecting entity"}
+	}
+
+	// the headroom is what move lets the entity pay, net of what it owes in open netting cycles
+	balance, available, found, err := spendable(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !found {
+		return pb.Response{Status: 404, Message: "Entity not found"}
+	}
+	lines, err := creditLines(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	type counterparty struct {
+		Counterparty string `json:"counterparty"`
+		Limit        int    `json:"limit"`
+		Utilisation  int    `json:"utilisation"`
+		Headroom     int    `json:"headroom"`
+	}
+	result := struct {
+		Entity         string         `json:"entity"`
+		Balance        int            `json:"balance"`
+		Headroom       int            `json:"headroom"`
+		Counterparties []counterparty `json:"counterparties"`
+	}{Entity: args[0], Balance: balance, Counterparties: []counterparty{}}
+
+	// a negative balance, after what is owed in cycles, uses the credit lines in the order of their creditors
+	limits := 0
+	for _, line := range lines {
+		limits += line.Limit
+	}
+	own := available - limits
+	owed := 0
+	if own < 0 {
+		owed = -own
+	}
+	for _, line := range lines {
+		used := owed
+		if used > line.Limit {
+			used = line.Limit
+		}
+		owed -= used
+		result.Counterparties = append(result.Counterparties, counterparty{line.Creditor, line.Limit, used, line.Limit - used})
+		result.Headroom += line.Limit - used
+	}
+	if own > 0 {
+		result.Headroom += own
+	}
+	if owed > 0 {
+		txLog(stub).Warningf("%s is %d over its credit limits", args[0], owed)
+	}
+
+	resultBytes, err := json.Marshal(result)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(resultBytes)
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// A netting cycle collects the moves of a period into one settlement. While a cycle is open, move
+// records the payment under cycleMove~cycle~tx instead of changing balances. Closing the cycle
+// sums the moves into gross obligations per pair and a net position per party, the net positions
+// are applied to the balances once every party confirmed them. Cycles live under cycle~id, the id
+// being the transaction that opened it, and the open one is named by the "cycle" config key. Closed
+// cycles awaiting confirmation keep their net positions under cycleUnsettled~id. Until a cycle settles, what a
+// party pays on net in it counts against what it may spend, what it receives does not yet. Only
+// the two parties the channel was initialised with open and close cycles.
+const (
+	cycleObjectType          = "cycle"
+	cycleMoveObjectType      = "cycleMove"
+	cycleUnsettledObjectType = "cycleUnsettled"
+)
+
+const (
+	cycleOpen    = "open"
+	cycleClosed  = "closed"
+	cycleSettled = "settled"
+)
+
+type obligation struct {
+	TxID   string `json:"txId,omitempty"` // the move, only on recorded moves
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Amount int    `json:"amount"`
+}
+
+type cycle struct {
+	ID            string            `json:"id"`
+	Status        string            `json:"status"`
+	OpenedAt      int64             `json:"openedAt"`
+	OpenedBy      string            `json:"openedBy"`
+	ClosedAt      int64             `json:"closedAt,omitempty"`
+	Moves         int               `json:"moves"`
+	Gross         []obligation      `json:"gross,omitempty"`
+	Net           map[string]int    `json:"net,omitempty"`
+	Confirmations map[string]string `json:"confirmations,omitempty"` // party to the identity that confirmed for it
+	SettledAt     int64             `json:"settledAt,omitempty"`
+}
+
+func getCycle(stub shim.ChaincodeStubInterface, cycleID string) (*cycle, error) {
+	c := &cycle{}
+	found, err := getJSON(stub, cycleObjectType, []string{cycleID}, c)
+	if err != nil || !found {
+		return nil, err
+	}
+	return c, nil
+}
+
+// currentCycle returns the open cycle, nil when there is none
+func currentCycle(stub shim.ChaincodeStubInterface) (*cycle, error) {
+	cycleID, err := getConfig(stub, "cycle")
+	if err != nil || cycleID == nil {
+		return nil, err
+	}
+	return getCycle(stub, string(cycleID))
+}
+
+// cycleMoves lists the moves recorded against a cycle
+func cycleMoves(stub shim.ChaincodeStubInterface, cycleID string) ([]obligation, error) {
+	it, err := stub.GetStateByPartialCompositeKey(cycleMoveObjectType, []string{cycleID})
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+
+	moves := []obligation{}
+	for it.HasNext() {
+		kv, err := it.Next()
+		if err != nil {
+			return nil, err
+		}
+		var move obligation
+		if err = json.Unmarshal(kv.Value, &move); err != nil {
+			return nil, err
+		}
+		moves = append(moves, move)
+	}
+
+	return moves, nil
+}
+
+// netPositions sums moves into what each party receives, negative for what it pays
+func netPositions(moves []obligation) map[string]int {
+	net := map[string]int{}
+	for _, move := range moves {
+		net[move.From] -= move.Amount
+		net[move.To] += move.Amount
+	}
+	return net
+}
+
+// owedInCycles is what an entity pays on net in the cycles not settled yet: the open cycle and the
+// closed ones awaiting confirmation
+func owedInCycles(stub shim.ChaincodeStubInterface, entity string) (int, error) {
+	owed := 0
+	open, err := currentCycle(stub)
+	if err != nil {
+		return 0, err
+	}
+	if open != nil {
+		moves, err := cycleMoves(stub, open.ID)
+		if err != nil {
+			return 0, err
+		}
+		if net := netPositions(moves)[entity]; net < 0 {
+			owed -= net
+		}
+	}
+
+	it, err := stub.GetStateByPartialCompositeKey(cycleUnsettledObjectType, []string{})
+	if err != nil {
+		return 0, err
+	}
+	defer it.Close()
+	for it.HasNext() {
+		kv, err := it.Next()
+		if err != nil {
+			return 0, err
+		}
+		var net map[string]int
+		if err = json.Unmarshal(kv.Value, &net); err != nil {
+			return 0, err
+		}
+		if net[entity] < 0 {
+			owed -= net[entity]
+		}
+	}
+
+	return owed, nil
+}
+
+// channelParty fails with status 403 unless the caller owns one of the parties of the channel
+func channelParty(stub shim.ChaincodeStubInterface, function string) pb.Response {
+	var parties []string
+	partiesBytes, err := getConfig(stub, "parties")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if partiesBytes != nil {
+		if err = json.Unmarshal(partiesBytes, &parties); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	id, err := getCreator(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	for _, party := range parties {
+		if id.owns(party) {
+			return shim.Success(nil)
+		}
+	}
+	return pb.Response{Status: 403, Message: "Only the parties of the channel may call " + function}
+}
+
+// recordCycleMove books a move against the open cycle instead of the balances
+func recordCycleMove(stub shim.ChaincodeStubInterface, c *cycle, from, to string, x int) error {
+	return putJSON(stub, cycleMoveObjectType, []string{c.ID, stub.GetTxID()}, obligation{stub.GetTxID(), from, to, x})
+}
+
+func putCycle(stub shim.ChaincodeStubInterface, event string, c *cycle) pb.Response {
+	if err := putJSON(stub, cycleObjectType, []string{c.ID}, c); err != nil {
+		return shim.Error(err.Error())
+	}
+	cycleBytes, err := json.Marshal(c)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err = stub.SetEvent(event, cycleBytes); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(cycleBytes)
+}
+
+// starts recording moves into a new cycle
+func (t *SimpleChaincode) openCycle(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 0 {
+		return pb.Response{Status: 403, Message: "Incorrect number of arguments. Expecting none"}
+	}
+	if response := channelParty(stub, "openCycle"); response.Status >= shim.ERRORTHRESHOLD {
+		return response
+	}
+
+	open, err := currentCycle(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if open != nil {
+		return pb.Response{Status: 409, Message: "Cycle " + open.ID + " is still open"}
+	}
+
+	id, err := getCreator(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	c := &cycle{ID: stub.GetTxID(), Status: cycleOpen, OpenedAt: now, OpenedBy: id.CommonName + "@" + id.Org}
+
+	if err = putConfig(stub, "cycle", []byte(c.ID)); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return putCycle(stub, "openCycle", c)
+}
+
+// stops recording moves and computes the gross and net obligations of the open cycle
+func (t *SimpleChaincode) closeCycle(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 0 {
+		return pb.Response{Status: 403, Message: "Incorrect number of arguments. Expecting none"}
+	}
+	if response := channelParty(stub, "closeCycle"); response.Status >= shim.ERRORTHRESHOLD {
+		return response
+	}
+
+	c, err := currentCycle(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if c == nil {
+		return pb.Response{Status: 404, Message: "No open cycle"}
+	}
+
+	moves, err := cycleMoves(stub, c.ID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	gross := map[[2]string]int{}
+	for _, move := range moves {
+		gross[[2]string{move.From, move.To}] += move.Amount
+	}
+	c.Gross = []obligation{}
+	for pair, amount := range gross {
+		c.Gross = append(c.Gross, obligation{From: pair[0], To: pair[1], Amount: amount})
+	}
+	sort.Slice(c.Gross, func(i, j int) bool {
+		if c.Gross[i].From != c.Gross[j].From {
+			return c.Gross[i].From < c.Gross[j].From
+		}
+		return c.Gross[i].To < c.Gross[j].To
+	})
+
+	c.Moves = len(moves)
+	c.Net = netPositions(moves)
+	c.Status = cycleClosed
+	if c.ClosedAt, err = txTime(stub); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	key, err := stub.CreateCompositeKey(configObjectType, []string{"cycle"})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err = stub.DelState(key); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// a cycle without moves has nothing to confirm
+	if len(c.Net) == 0 {
+		c.Status = cycleSettled
+		c.SettledAt = c.ClosedAt
+	} else if err = putJSON(stub, cycleUnsettledObjectType, []string{c.ID}, c.Net); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return putCycle(stub, "closeCycle", c)
+}
+
+// confirms the net positions of a closed cycle for a party of the caller, the last confirmation
+// applies them to the balances: cycle id and party
+func (t *SimpleChaincode) confirmCycle(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		return pb.Response{Status: 403, Message: "Incorrect number of arguments. Expecting cycle id and party"}
+	}
+
+	c, err := getCycle(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if c == nil {
+		return pb.Response{Status: 404, Message: "Cycle not found"}
+	}
+	if c.Status != cycleClosed {
+		return pb.Response{Status: 403, Message: "Cycle is " + c.Status}
+	}
+	party := args[1]
+	if _, ok := c.Net[party]; !ok {
+		return pb.Response{Status: 403, Message: party + " is not a party of the cycle"}
+	}
+	if c.Confirmations[party] != "" {
+		return pb.Response{Status: 409, Message: party + " already confirmed the cycle"}
+	}
+
+	id, err := getCreator(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !id.owns(party) {
+		return pb.Response{Status: 403, Message: "Only the owner of " + party + " may confirm for it"}
+	}
+	if c.Confirmations == nil {
+		c.Confirmations = map[string]string{}
+	}
+	c.Confirmations[party] = id.CommonName + "@" + id.Org
+
+	if len(c.Confirmations) < len(c.Net) {
+		return putCycle(stub, "confirmCycle", c)
+	}
+
+	parties := make([]string, 0, len(c.Net))
+	for party := range c.Net {
+		parties = append(parties, party)
+	}
+	sort.Strings(parties)
+	for _, party := range parties {
+		if err = addBalance(stub, party, c.Net[party]); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	key, err := stub.CreateCompositeKey(cycleUnsettledObjectType, []string{c.ID})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err = stub.DelState(key); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	c.Status = cycleSettled
+	if c.SettledAt, err = txTime(stub); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return putCycle(stub, "settleCycle", c)
+}
+
+// settlement statement of a cycle with every move it recorded, for reconciliation: cycle id, the
+// open cycle with its running net positions when omitted
+func (t *SimpleChaincode) statement(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) > 1 {
+		return pb.Response{Status: 403, Message: "Incorrect number of arguments. Expecting optional cycle id"}
+	}
+
+	var c *cycle
+	var err error
+	if len(args) == 1 {
+		c, err = getCycle(stub, args[0])
+	} else {
+		c, err = currentCycle(stub)
+	}
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if c == nil {
+		return pb.Response{Status: 404, Message: "Cycle not found"}
+	}
+	moves, err := cycleMoves(stub, c.ID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if c.Status == cycleOpen {
+		c.Moves = len(moves)
+		c.Net = netPositions(moves)
+	}
+
+	statement := struct {
+		*cycle
+		Channel  string       `json:"channel"`
+		Recorded []obligation `json:"recorded"`
+	}{c, stub.GetChannelID(), moves}
+
+	statementBytes, err := json.Marshal(statement)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(statementBytes)
+}
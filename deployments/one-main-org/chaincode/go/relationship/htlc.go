@@ -0,0 +1,246 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Hash time-locked contracts make a payment routed over several bilateral channels settle on all
+// of them or on none. The sender locks funds for the receiver under the SHA-256 hash of a secret
+// and a timeout, the receiver claims them by revealing the secret before the timeout, otherwise
+// they go back to the sender. A route a-b-c locks on a-b and then on b-c with the same hash and a
+// shorter timeout: c reveals the secret on b-c to get paid, which lets b claim on a-b in turn.
+// Contracts live under htlc~id, the id being the transaction that locked the funds.
+const htlcObjectType = "htlc"
+
+const (
+	htlcLocked   = "locked"
+	htlcClaimed  = "claimed"
+	htlcRefunded = "refunded"
+)
+
+type htlc struct {
+	ID       string `json:"id"`
+	Sender   string `json:"sender"`
+	Receiver string `json:"receiver"`
+	Amount   int    `json:"amount"`
+	Hashlock string `json:"hashlock"` // hex SHA-256 of the preimage
+	Timelock int64  `json:"timelock"` // unix seconds
+	Status   string `json:"status"`
+	Preimage string `json:"preimage,omitempty"`
+}
+
+func loadHTLC(stub shim.ChaincodeStubInterface, htlcID string) (*htlc, error) {
+	key, err := stub.CreateCompositeKey(htlcObjectType, []string{htlcID})
+	if err != nil {
+		return nil, err
+	}
+	htlcBytes, err := stub.GetState(key)
+	if err != nil || htlcBytes == nil {
+		return nil, err
+	}
+	h := &htlc{}
+	return h, json.Unmarshal(htlcBytes, h)
+}
+
+// putHTLC stores the contract and sends it as the event of the transaction
+func putHTLC(stub shim.ChaincodeStubInterface, event string, h *htlc) pb.Response {
+	key, err := stub.CreateCompositeKey(htlcObjectType, []string{h.ID})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	htlcBytes, err := json.Marshal(h)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if err = stub.PutState(key, htlcBytes); err != nil {
+		return shim.Error(err.Error())
+	}
+	if err = stub.SetEvent(event, htlcBytes); err != nil {
+		return shim.Error(err.Error())
+	}
+	return shim.Success(htlcBytes)
+}
+
+func txTime(stub shim.ChaincodeStubInterface) (int64, error) {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return 0, err
+	}
+	return ts.Seconds, nil
+}
+
+// parseTime accepts unix seconds or an RFC 3339 time
+func parseTime(value string) (int64, error) {
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return seconds, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %s, expecting unix seconds or RFC 3339 time", value)
+	}
+	return t.Unix(), nil
+}
+
+// owns tells whether the identity may pay from the entity, the one named after its org or itself
+func (id *identity) owns(entity string) bool {
+	return entity == id.Org || entity == id.CommonName+"@"+id.Org
+}
+
+// locks funds of the caller for a receiver: sender, receiver, amount, hex SHA-256 hashlock and timelock
+func (t *SimpleChaincode) lock(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 5 {
+		return pb.Response{Status: 403, Message: "Incorrect number of arguments. Expecting sender, receiver, amount, hashlock and timelock"}
+	}
+
+	h := &htlc{ID: stub.GetTxID(), Sender: args[0], Receiver: args[1], Hashlock: strings.ToLower(args[3]), Status: htlcLocked}
+
+	x, err := strconv.Atoi(args[2])
+	if err != nil || x <= 0 {
+		return pb.Response{Status: 403, Message: "Invalid amount, expecting a positive integer"}
+	}
+	h.Amount = x
+	if hash, err := hex.DecodeString(h.Hashlock); err != nil || len(hash) != sha256.Size {
+		return pb.Response{Status: 403, Message: "Invalid hashlock, expecting a hex SHA-256 hash"}
+	}
+	if h.Timelock, err = parseTime(args[4]); err != nil {
+		return pb.Response{Status: 403, Message: err.Error()}
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if h.Timelock <= now {
+		return pb.Response{Status: 403, Message: "Timelock must be in the future"}
+	}
+
+	id, err := getCreator(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !id.owns(h.Sender) {
+		return pb.Response{Status: 403, Message: "Only the owner of " + h.Sender + " may lock its funds"}
+	}
+
+	_, available, senderFound, err := spendable(stub, h.Sender)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	_, receiverFound, err := getBalance(stub, h.Receiver)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !senderFound || !receiverFound {
+		return pb.Response{Status: 404, Message: "Entity not found"}
+	}
+	if available < x {
+		return pb.Response{Status: 403, Message: fmt.Sprintf("Insufficient funds: %s can pay %d within its credit limits", h.Sender, available)}
+	}
+
+	// the funds leave the sender now and reach the receiver or come back on claim or refund
+	if err = addBalance(stub, h.Sender, -x); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return putHTLC(stub, "lock", h)
+}
+
+// pays locked funds to the receiver, anyone knowing the preimage may claim before the timelock: id and preimage
+func (t *SimpleChaincode) claim(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		return pb.Response{Status: 403, Message: "Incorrect number of arguments. Expecting id and preimage"}
+	}
+
+	h, err := loadHTLC(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if h == nil {
+		return pb.Response{Status: 404, Message: "Contract not found"}
+	}
+	if h.Status != htlcLocked {
+		return pb.Response{Status: 403, Message: "Contract is " + h.Status}
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if now >= h.Timelock {
+		return pb.Response{Status: 403, Message: "Contract timed out at " + strconv.FormatInt(h.Timelock, 10)}
+	}
+	hash := sha256.Sum256([]byte(args[1]))
+	if hex.EncodeToString(hash[:]) != h.Hashlock {
+		return pb.Response{Status: 403, Message: "Preimage does not match the hashlock"}
+	}
+
+	if err = addBalance(stub, h.Receiver, h.Amount); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// the preimage goes on the ledger and in the event so the upstream hop can claim with it
+	h.Status = htlcClaimed
+	h.Preimage = args[1]
+	return putHTLC(stub, "claim", h)
+}
+
+// returns locked funds to the sender once the timelock passed: id
+func (t *SimpleChaincode) refund(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return pb.Response{Status: 403, Message: "Incorrect number of arguments. Expecting id"}
+	}
+
+	h, err := loadHTLC(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if h == nil {
+		return pb.Response{Status: 404, Message: "Contract not found"}
+	}
+	if h.Status != htlcLocked {
+		return pb.Response{Status: 403, Message: "Contract is " + h.Status}
+	}
+	now, err := txTime(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if now < h.Timelock {
+		return pb.Response{Status: 403, Message: "Contract is locked until " + strconv.FormatInt(h.Timelock, 10)}
+	}
+
+	if err = addBalance(stub, h.Sender, h.Amount); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	h.Status = htlcRefunded
+	return putHTLC(stub, "refund", h)
+}
+
+// reads a contract: id
+func (t *SimpleChaincode) getHTLC(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return pb.Response{Status: 403, Message: "Incorrect number of arguments. Expecting id"}
+	}
+
+	h, err := loadHTLC(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if h == nil {
+		return pb.Response{Status: 404, Message: "Contract not found"}
+	}
+
+	htlcBytes, err := json.Marshal(h)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(htlcBytes)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric/protos/msp"
+)
+
+// oid of the certificate extension fabric-ca puts enrollment attributes in
+var attributesOID = asn1.ObjectIdentifier{1, 2, 3, 4, 5, 6, 7, 8, 1}
+
+// identity is what the chaincode knows about the creator of a transaction
+type identity struct {
+	MSPID        string            `json:"mspId"`
+	CommonName   string            `json:"cn"`
+	Organization string            `json:"issuerOrg"`
+	Org          string            `json:"org"`
+	OUs          []string          `json:"ous"`
+	Attributes   map[string]string `json:"attrs"`
+	NotBefore    time.Time         `json:"notBefore"`
+	NotAfter     time.Time         `json:"notAfter"`
+}
+
+// parseCreator resolves the serialized identity returned by stub.GetCreator
+func parseCreator(creatorBytes []byte) (*identity, error) {
+	sid := &msp.SerializedIdentity{}
+	if err := proto.Unmarshal(creatorBytes, sid); err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(sid.IdBytes)
+	if block == nil {
+		return nil, errors.New("no PEM certificate in creator")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if len(cert.Issuer.Organization) == 0 {
+		return nil, errors.New("creator certificate has no issuer organization")
+	}
+
+	id := &identity{
+		MSPID:        sid.Mspid,
+		CommonName:   cert.Subject.CommonName,
+		Organization: cert.Issuer.Organization[0],
+		Org:          strings.Split(cert.Issuer.Organization[0], ".")[0],
+		OUs:          cert.Subject.OrganizationalUnit,
+		Attributes:   map[string]string{},
+		NotBefore:    cert.NotBefore,
+		NotAfter:     cert.NotAfter,
+	}
+
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(attributesOID) {
+			continue
+		}
+		var attrs struct {
+			Attrs map[string]string `json:"attrs"`
+		}
+		if err := json.Unmarshal(ext.Value, &attrs); err != nil {
+			return nil, errors.New("cannot parse certificate attributes: " + err.Error())
+		}
+		for k, v := range attrs.Attrs {
+			id.Attributes[k] = v
+		}
+	}
+
+	return id, nil
+}
+
+// roles are the OUs of the certificate plus the comma separated values of its "role" attribute
+func (id *identity) roles() []string {
+	seen := map[string]bool{}
+	var roles []string
+	add := func(role string) {
+		role = strings.TrimSpace(role)
+		if role != "" && !seen[role] {
+			seen[role] = true
+			roles = append(roles, role)
+		}
+	}
+	for _, ou := range id.OUs {
+		add(ou)
+	}
+	for _, role := range strings.Split(id.Attributes["role"], ",") {
+		add(role)
+	}
+	sort.Strings(roles)
+	return roles
+}
+
+func (id *identity) hasRole(role string) bool {
+	for _, r := range id.roles() {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// canInvoke tells whether the access policy lets the identity call the function
+func (id *identity) canInvoke(function string) bool {
+	f, ok := functions[function]
+	if !ok {
+		return false
+	}
+	return f.role == "" || id.hasRole(f.role)
+}
+
+// permissions lists the functions the identity may call, sorted by name
+func (id *identity) permissions() []string {
+	var names []string
+	for name := range functions {
+		if id.canInvoke(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// getBalance returns the balance of an entity, found is false when the entity does not exist
+func getBalance(stub shim.ChaincodeStubInterface, entity string) (balance int, found bool, err error) {
+	valBytes, err := stub.GetState(entity)
+	if err != nil || valBytes == nil {
+		return 0, false, err
+	}
+	balance, _ = strconv.Atoi(string(valBytes))
+	return balance, true, nil
+}
+
+// addBalance credits a positive or debits a negative amount to an existing entity
+func addBalance(stub shim.ChaincodeStubInterface, entity string, amount int) error {
+	balance, found, err := getBalance(stub, entity)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("entity %s not found", entity)
+	}
+	txLog(stub).Debugf("%s = %d", entity, balance+amount)
+	return stub.PutState(entity, []byte(strconv.Itoa(balance+amount)))
+}
+
+// getJSON reads the json value of a composite key into v, found is false when the key does not exist
+func getJSON(stub shim.ChaincodeStubInterface, objectType string, attributes []string, v interface{}) (found bool, err error) {
+	key, err := stub.CreateCompositeKey(objectType, attributes)
+	if err != nil {
+		return false, err
+	}
+	valueBytes, err := stub.GetState(key)
+	if err != nil || valueBytes == nil {
+		return false, err
+	}
+	return true, json.Unmarshal(valueBytes, v)
+}
+
+// putJSON writes v as the json value of a composite key
+func putJSON(stub shim.ChaincodeStubInterface, objectType string, attributes []string, v interface{}) error {
+	key, err := stub.CreateCompositeKey(objectType, attributes)
+	if err != nil {
+		return err
+	}
+	valueBytes, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(key, valueBytes)
+}